@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is a stable, machine-readable error identifier. Clients switch on
+// the code; the message is for humans and may change.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest   ErrorCode = "INVALID_REQUEST"
+	CodeInvalidAddress   ErrorCode = "INVALID_ADDRESS"
+	CodeAlreadyLiked     ErrorCode = "ALREADY_LIKED"
+	CodeNotLiked         ErrorCode = "NOT_LIKED"
+	CodePostNotFound     ErrorCode = "POST_NOT_FOUND"
+	CodeUnknownCampaign  ErrorCode = "UNKNOWN_CAMPAIGN"
+	CodeNoTrustline      ErrorCode = "NO_TRUSTLINE"
+	CodeAccountNotFunded ErrorCode = "ACCOUNT_NOT_FUNDED"
+	CodeIPFSUnavailable  ErrorCode = "IPFS_UNAVAILABLE"
+	CodeChainUnavailable ErrorCode = "CHAIN_UNAVAILABLE"
+	CodeStorageFailed    ErrorCode = "STORAGE_FAILED"
+	CodeHeadUnavailable  ErrorCode = "HEAD_UNAVAILABLE"
+	CodeInternal         ErrorCode = "INTERNAL"
+	CodePayloadTooLarge  ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeUploadNotFound   ErrorCode = "UPLOAD_NOT_FOUND"
+	CodeOffsetMismatch   ErrorCode = "OFFSET_MISMATCH"
+	CodeUploadIncomplete ErrorCode = "UPLOAD_INCOMPLETE"
+	CodeUnsupportedMedia ErrorCode = "UNSUPPORTED_MEDIA"
+	CodeUnauthorized     ErrorCode = "UNAUTHORIZED"
+	CodeJobNotFound      ErrorCode = "JOB_NOT_FOUND"
+)
+
+// errorStatus is the HTTP status each code is reported with.
+var errorStatus = map[ErrorCode]int{
+	CodeInvalidRequest:   http.StatusBadRequest,
+	CodeInvalidAddress:   http.StatusBadRequest,
+	CodeAlreadyLiked:     http.StatusConflict,
+	CodeNotLiked:         http.StatusConflict,
+	CodePostNotFound:     http.StatusNotFound,
+	CodeUnknownCampaign:  http.StatusBadRequest,
+	CodeNoTrustline:      http.StatusUnprocessableEntity,
+	CodeAccountNotFunded: http.StatusUnprocessableEntity,
+	CodeIPFSUnavailable:  http.StatusBadGateway,
+	CodeChainUnavailable: http.StatusBadGateway,
+	CodeStorageFailed:    http.StatusBadGateway,
+	CodeHeadUnavailable:  http.StatusServiceUnavailable,
+	CodeInternal:         http.StatusInternalServerError,
+	CodePayloadTooLarge:  http.StatusRequestEntityTooLarge,
+	CodeUploadNotFound:   http.StatusNotFound,
+	CodeOffsetMismatch:   http.StatusConflict,
+	CodeUploadIncomplete: http.StatusConflict,
+	CodeUnsupportedMedia: http.StatusUnsupportedMediaType,
+	CodeUnauthorized:     http.StatusUnauthorized,
+	CodeJobNotFound:      http.StatusNotFound,
+}
+
+// APIError is an error with a code from the catalog above. Err keeps the
+// underlying cause for logs and errors.Is.
+type APIError struct {
+	Code    ErrorCode
+	Message string
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func (e *APIError) status() int {
+	if status, ok := errorStatus[e.Code]; ok {
+		return status
+	}
+
+	return http.StatusInternalServerError
+}
+
+// apiError tags err with a code. The message is err's message unless msg is
+// given.
+func apiError(code ErrorCode, err error, msg ...string) *APIError {
+	e := &APIError{Code: code, Err: err}
+
+	switch {
+	case len(msg) > 0:
+		e.Message = msg[0]
+	case err != nil:
+		e.Message = err.Error()
+	default:
+		e.Message = string(code)
+	}
+
+	return e
+}
+
+func apiErrorf(code ErrorCode, format string, args ...any) *APIError {
+	return apiError(code, fmt.Errorf(format, args...))
+}
+
+var (
+	errAlreadyLiked   = apiError(CodeAlreadyLiked, nil, "user has already liked the post")
+	errNotLiked       = apiError(CodeNotLiked, nil, "user has not liked the post")
+	errPostNotFound   = apiError(CodePostNotFound, nil, "post not found")
+	errUploadNotFound = apiError(CodeUploadNotFound, nil, "upload session not found or expired")
+	errJobNotFound    = apiError(CodeJobNotFound, nil, "no failed mirror job with that id")
+	errUnauthorized   = apiError(CodeUnauthorized, nil, "missing or invalid admin token")
+)
+
+// errorCode picks the code and status for any error handed to errorJSON.
+// Untagged errors are reported with the status the handler asked for, which
+// is 500 unless it passed one: anything the client got wrong is tagged.
+func errorCode(err error, status int) (ErrorCode, int) {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae.Code, ae.status()
+	}
+
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return ve.code(), http.StatusBadRequest
+	}
+
+	if status >= http.StatusInternalServerError {
+		return CodeInternal, status
+	}
+
+	return CodeInvalidRequest, status
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// Attachment is one media file of a post. Posts keep their attachments in
+// upload order; the first one is also published as the post's image_hash
+// for clients that only show a single file. URLs is only filled in when a
+// post is served.
+type Attachment struct {
+	CID      string            `json:"cid"`
+	URLs     []string          `json:"urls,omitempty"`
+	MimeType string            `json:"mime_type,omitempty"`
+	Size     int64             `json:"size,omitempty"`
+	SHA256   string            `json:"sha256,omitempty"`
+	Width    int               `json:"width,omitempty"`
+	Height   int               `json:"height,omitempty"`
+	Variants map[string]string `json:"variants,omitempty"`
+	Duration float64           `json:"duration,omitempty"`
+	Codec    string            `json:"codec,omitempty"`
+	Poster   string            `json:"poster,omitempty"`
+}
+
+func newAttachment(media *storedMedia) Attachment {
+	a := Attachment{
+		CID:      media.CID,
+		MimeType: media.MimeType,
+		Size:     media.Size,
+		SHA256:   media.SHA256,
+		Width:    media.Width,
+		Height:   media.Height,
+	}
+
+	if len(media.Variants) > 0 {
+		// Images smaller than a variant are served from the original.
+		a.Variants = make(map[string]string)
+		for _, name := range []string{variantThumbnail, variantMedium, variantOriginal} {
+			cid, ok := media.Variants[name]
+			if !ok {
+				cid = media.CID
+			}
+			a.Variants[name] = cid
+		}
+	}
+
+	if media.Video != nil {
+		a.Duration = media.Video.Duration
+		a.Codec = media.Video.Codec
+		a.Poster = media.Poster
+	}
+
+	return a
+}
+
+// migrateMedia brings the media fields of a post up to date (schema
+// version 1, see migrations):
+//   - posts written before posts had attachments get their single file as a
+//     one-element list. Its size, hash and type were stored on the post
+//     itself, under the names Attachment uses.
+//   - gateway URLs from before records held bare CIDs are reduced to the CID.
+func migrateMedia(post []byte, imageHash string, attachments []Attachment) (string, []Attachment) {
+	if len(attachments) == 0 && imageHash != "" {
+		var a Attachment
+		json.Unmarshal(post, &a)
+		a.CID = imageHash
+		attachments = []Attachment{a}
+	}
+
+	for i := range attachments {
+		a := &attachments[i]
+		a.CID = bareCID(a.CID)
+		for name, ref := range a.Variants {
+			a.Variants[name] = bareCID(ref)
+		}
+		a.Poster = bareCID(a.Poster)
+	}
+
+	return bareCID(imageHash), attachments
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// BlobStore keeps media files. Put returns the key the file is stored under
+// and which post records reference: a CID for IPFS, the hex SHA-256 of the
+// content for the others. Post URLs are rendered from IPFS_GATEWAYS as
+// <gateway>/ipfs/<key>, so a primary other than IPFS needs a gateway that
+// serves keys under that path, e.g. an S3 bucket with S3_PREFIX=ipfs/.
+type BlobStore interface {
+	Name() string
+	Put(ctx context.Context, r io.Reader) (string, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+const (
+	blobStoreIPFS = "ipfs"
+	blobStoreFS   = "fs"
+	blobStoreS3   = "s3"
+
+	// mirrorStorageService names the storage service as a mirror target.
+	mirrorStorageService = "storage"
+)
+
+var errBadBlobKey = errors.New("invalid blob key")
+
+// newBlobStore builds the backend called name from the environment.
+func newBlobStore(name string, app *Config) (BlobStore, error) {
+	switch name {
+	case blobStoreIPFS:
+		return &IPFSStore{Node: app.IPFSNode}, nil
+	case blobStoreFS:
+		return &FSStore{Root: envOr("BLOB_DIR", "blobs")}, nil
+	case blobStoreS3:
+		s := &S3Store{
+			Endpoint:  strings.TrimRight(envOr("S3_ENDPOINT", ""), "/"),
+			Bucket:    envOr("S3_BUCKET", ""),
+			Prefix:    envOr("S3_PREFIX", ""),
+			Region:    envOr("S3_REGION", "us-east-1"),
+			AccessKey: envOr("S3_ACCESS_KEY", ""),
+			SecretKey: envOr("S3_SECRET_KEY", ""),
+			HTTP:      &http.Client{Timeout: 30 * time.Minute},
+		}
+		if s.Endpoint == "" || s.Bucket == "" {
+			return nil, errors.New("s3 store needs S3_ENDPOINT and S3_BUCKET")
+		}
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("unknown blob store %q", name)
+}
+
+// configureStores sets up the primary store and the mirror targets from
+// their comma separated names. "storage" is the storage service, which is
+// not a BlobStore of its own.
+func (app *Config) configureStores(primary, mirrors string) error {
+	store, err := newBlobStore(primary, app)
+	if err != nil {
+		return err
+	}
+	app.Store = store
+
+	app.MirrorStores = make(map[string]BlobStore)
+	for _, name := range strings.Split(mirrors, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if name != mirrorStorageService {
+			if name == primary {
+				return fmt.Errorf("blob store %q cannot mirror itself", name)
+			}
+			app.MirrorStores[name], err = newBlobStore(name, app)
+			if err != nil {
+				return err
+			}
+		}
+		app.MirrorTargets = append(app.MirrorTargets, name)
+	}
+
+	return nil
+}
+
+// storeFailed wraps an error of the primary store for the client.
+func (app *Config) storeFailed(err error) error {
+	if app.Store.Name() == blobStoreIPFS {
+		return apiError(CodeIPFSUnavailable, err, "error adding media to IPFS")
+	}
+
+	return apiError(CodeStorageFailed, err, "error storing media")
+}
+
+// IPFSStore adds files through the IPFS HTTP API.
+type IPFSStore struct {
+	Node string
+}
+
+func (s *IPFSStore) Name() string { return blobStoreIPFS }
+
+func (s *IPFSStore) Put(ctx context.Context, r io.Reader) (string, error) {
+	return shell.NewShell(s.Node).Add(r)
+}
+
+func (s *IPFSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return shell.NewShell(s.Node).Cat(key)
+}
+
+// validBlobKey accepts the hex SHA-256 keys of the content-hashed stores.
+func validBlobKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// FSStore keeps files in a local directory, named by their SHA-256.
+type FSStore struct {
+	Root string
+}
+
+func (s *FSStore) Name() string { return blobStoreFS }
+
+func (s *FSStore) Put(ctx context.Context, r io.Reader) (string, error) {
+	err := os.MkdirAll(s.Root, 0o700)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(s.Root, ".put-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	key := hex.EncodeToString(h.Sum(nil))
+	return key, os.Rename(tmp.Name(), filepath.Join(s.Root, key))
+}
+
+func (s *FSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validBlobKey(key) {
+		return nil, errBadBlobKey
+	}
+
+	return os.Open(filepath.Join(s.Root, key))
+}
+
+// S3Store keeps files in a bucket of an S3-compatible service such as
+// MinIO, using path-style URLs and Signature Version 4.
+type S3Store struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	HTTP      *http.Client
+}
+
+func (s *S3Store) Name() string { return blobStoreS3 }
+
+// Put hashes the content first, because the hash is both the object key
+// and the signed payload hash. Anything that is not a file is spooled.
+func (s *S3Store) Put(ctx context.Context, r io.Reader) (string, error) {
+	file, ok := r.(*os.File)
+	if !ok {
+		tmp, err := os.CreateTemp("", "s3-put-*")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		_, err = io.Copy(tmp, r)
+		if err != nil {
+			return "", err
+		}
+		file = tmp
+	}
+
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	_, err = file.Seek(start, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(payloadHash), io.NopCloser(file))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+
+	res, err := s.do(req, payloadHash)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+
+	return payloadHash, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validBlobKey(key) {
+		return nil, errBadBlobKey
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (s *S3Store) objectURL(key string) string {
+	return s.Endpoint + "/" + s.Bucket + "/" + s.Prefix + key
+}
+
+// do signs and sends req, turning error statuses into errors.
+func (s *S3Store) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	signV4(req, payloadHash, s.Region, s.AccessKey, s.SecretKey, time.Now())
+
+	res, err := s.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s answered %s: %s", req.Method, req.URL.Path, res.Status, body)
+	}
+
+	return res, nil
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 adds AWS Signature Version 4 headers for the s3 service.
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath encodes each path segment as SigV4 expects: everything but
+// unreserved characters, with slashes left alone.
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = sigV4Escape(seg)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func sigV4Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, sigV4Escape(k)+"="+sigV4Escape(v))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Just enough of CIDs, multihash and UnixFS to check that bytes fetched
+// from someone else's gateway are the content we asked for.
+
+const (
+	codecRaw   = 0x55
+	codecDagPB = 0x70
+
+	multihashSHA256 = 0x12
+)
+
+var errBadCID = errors.New("invalid CID")
+
+var errBadBlock = errors.New("malformed dag-pb block")
+
+type cidInfo struct {
+	Version int
+	Codec   uint64
+	Hash    uint64
+	Digest  []byte
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, c := range []byte(s) {
+		i := strings.IndexByte(base58Alphabet, c)
+		if i < 0 {
+			return nil, errBadCID
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+
+	out := n.Bytes()
+	for i := 0; i < len(s) && s[i] == '1'; i++ {
+		out = append([]byte{0}, out...)
+	}
+
+	return out, nil
+}
+
+func readUvarint(b []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errBadCID
+	}
+
+	return v, b[n:], nil
+}
+
+// parseCID decodes a CIDv0 ("Qm...") or a base32 CIDv1 ("b...").
+func parseCID(s string) (*cidInfo, error) {
+	var raw []byte
+	var err error
+	info := &cidInfo{}
+
+	switch {
+	case len(s) == 46 && strings.HasPrefix(s, "Qm"):
+		raw, err = base58Decode(s)
+		info.Version = 0
+		info.Codec = codecDagPB
+	case strings.HasPrefix(s, "b"):
+		raw, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s[1:]))
+		if err != nil {
+			return nil, errBadCID
+		}
+		var version uint64
+		version, raw, err = readUvarint(raw)
+		if err == nil && version != 1 {
+			err = errBadCID
+		}
+		if err == nil {
+			info.Version = 1
+			info.Codec, raw, err = readUvarint(raw)
+		}
+	default:
+		return nil, fmt.Errorf("%w: only CIDv0 and base32 CIDv1 are supported", errBadCID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.Hash, raw, err = readUvarint(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	length, raw, err := readUvarint(raw)
+	if err != nil || uint64(len(raw)) != length {
+		return nil, errBadCID
+	}
+	info.Digest = raw
+
+	return info, nil
+}
+
+// matchesBlock reports whether block hashes to the CID.
+func (c *cidInfo) matchesBlock(block []byte) bool {
+	if c.Hash != multihashSHA256 {
+		return false
+	}
+
+	sum := sha256.Sum256(block)
+	return string(sum[:]) == string(c.Digest)
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3))
+	return binary.AppendUvarint(b, v)
+}
+
+// unixfsFileBlock encodes a file that fits in one chunk the way ipfs add
+// does: a dag-pb node without links whose data is a UnixFS File.
+func unixfsFileBlock(content []byte) []byte {
+	var data []byte
+	data = appendProtoVarint(data, 1, 2) // Type: File
+	if len(content) > 0 {
+		data = appendProtoBytes(data, 2, content)
+	}
+	data = appendProtoVarint(data, 3, uint64(len(content)))
+
+	return appendProtoBytes(nil, 1, data)
+}
+
+// errUnverifiable is returned for content that cannot be checked from the
+// file bytes alone, i.e. files spread over several blocks. Those have to be
+// read block by block (see GatewayClient.readDAG).
+var errUnverifiable = errors.New("content spans several blocks")
+
+// verifyContent checks that content is the file the CID names.
+func verifyContent(cid string, content []byte) error {
+	info, err := parseCID(cid)
+	if err != nil {
+		return err
+	}
+
+	switch info.Codec {
+	case codecRaw:
+		if info.matchesBlock(content) {
+			return nil
+		}
+	case codecDagPB:
+		if info.matchesBlock(unixfsFileBlock(content)) {
+			return nil
+		}
+		if len(content) > unixfsChunkSize {
+			return errUnverifiable
+		}
+	default:
+		return fmt.Errorf("%w: unsupported codec 0x%x", errBadCID, info.Codec)
+	}
+
+	return fmt.Errorf("content does not match %s", cid)
+}
+
+// unixfsChunkSize is the default chunk size of ipfs add.
+const unixfsChunkSize = 256 << 10
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	mod := new(big.Int)
+	radix := big.NewInt(58)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for i := 0; i < len(b) && b[i] == 0; i++ {
+		out = append(out, '1')
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return string(out)
+}
+
+// cidFromBytes decodes the binary CID of a dag-pb link.
+func cidFromBytes(b []byte) (*cidInfo, error) {
+	info := &cidInfo{}
+	var err error
+
+	if len(b) == 34 && b[0] == multihashSHA256 && b[1] == 32 {
+		info.Version = 0
+		info.Codec = codecDagPB
+	} else {
+		var version uint64
+		version, b, err = readUvarint(b)
+		if err != nil || version != 1 {
+			return nil, errBadCID
+		}
+		info.Version = 1
+		info.Codec, b, err = readUvarint(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info.Hash, b, err = readUvarint(b)
+	if err != nil {
+		return nil, err
+	}
+
+	length, b, err := readUvarint(b)
+	if err != nil || uint64(len(b)) != length {
+		return nil, errBadCID
+	}
+	info.Digest = b
+
+	return info, nil
+}
+
+func (c *cidInfo) String() string {
+	mh := binary.AppendUvarint(nil, c.Hash)
+	mh = binary.AppendUvarint(mh, uint64(len(c.Digest)))
+	mh = append(mh, c.Digest...)
+
+	if c.Version == 0 {
+		return base58Encode(mh)
+	}
+
+	b := binary.AppendUvarint(nil, 1)
+	b = binary.AppendUvarint(b, c.Codec)
+	b = append(b, mh...)
+
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
+
+// protoFields calls fn for every field of a protobuf message. Only bytes
+// and varint fields are handed on; other wire types are skipped.
+func protoFields(msg []byte, fn func(field int, varint uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		tag, rest, err := readUvarint(msg)
+		if err != nil {
+			return errBadBlock
+		}
+		msg = rest
+		field := int(tag >> 3)
+
+		switch tag & 7 {
+		case 0:
+			v, rest, err := readUvarint(msg)
+			if err != nil {
+				return errBadBlock
+			}
+			msg = rest
+			err = fn(field, v, nil)
+			if err != nil {
+				return err
+			}
+		case 2:
+			n, rest, err := readUvarint(msg)
+			if err != nil || n > uint64(len(rest)) {
+				return errBadBlock
+			}
+			data := rest[:n]
+			msg = rest[n:]
+			err = fn(field, 0, data)
+			if err != nil {
+				return err
+			}
+		case 1:
+			if len(msg) < 8 {
+				return errBadBlock
+			}
+			msg = msg[8:]
+		case 5:
+			if len(msg) < 4 {
+				return errBadBlock
+			}
+			msg = msg[4:]
+		default:
+			return errBadBlock
+		}
+	}
+
+	return nil
+}
+
+const (
+	unixfsRaw  = 0
+	unixfsFile = 2
+)
+
+// dagNode is the part of a dag-pb node holding a UnixFS file.
+type dagNode struct {
+	Links []*cidInfo
+	Type  uint64
+	Data  []byte
+}
+
+func decodeDagPB(block []byte) (*dagNode, error) {
+	node := &dagNode{}
+	var unixfs []byte
+
+	err := protoFields(block, func(field int, _ uint64, data []byte) error {
+		switch field {
+		case 1:
+			unixfs = data
+		case 2:
+			var hash []byte
+			err := protoFields(data, func(field int, _ uint64, data []byte) error {
+				if field == 1 {
+					hash = data
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			link, err := cidFromBytes(hash)
+			if err != nil {
+				return err
+			}
+			node.Links = append(node.Links, link)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if unixfs == nil {
+		return nil, fmt.Errorf("%w: no UnixFS data", errBadBlock)
+	}
+
+	err = protoFields(unixfs, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			node.Type = v
+		case 2:
+			node.Data = data
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if node.Type != unixfsFile && node.Type != unixfsRaw {
+		return nil, fmt.Errorf("%w: UnixFS type %d is not a file", errBadBlock, node.Type)
+	}
+
+	return node, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// cidBytes is the binary form of c, as a dag-pb link holds it.
+func cidBytes(c *cidInfo) []byte {
+	var b []byte
+	if c.Version == 1 {
+		b = binary.AppendUvarint(b, 1)
+		b = binary.AppendUvarint(b, c.Codec)
+	}
+	b = binary.AppendUvarint(b, c.Hash)
+	b = binary.AppendUvarint(b, uint64(len(c.Digest)))
+	return append(b, c.Digest...)
+}
+
+func blockCID(version int, codec uint64, block []byte) *cidInfo {
+	sum := sha256.Sum256(block)
+	return &cidInfo{Version: version, Codec: codec, Hash: multihashSHA256, Digest: sum[:]}
+}
+
+// dagPBNode encodes a dag-pb node with links and UnixFS data of the given
+// type, listing the size of every link as ipfs add does for a file.
+func dagPBNode(typ uint64, links []*cidInfo, sizes []int) []byte {
+	var unixfs []byte
+	unixfs = appendProtoVarint(unixfs, 1, typ)
+	total := 0
+	for _, n := range sizes {
+		total += n
+	}
+	unixfs = appendProtoVarint(unixfs, 3, uint64(total))
+	for _, n := range sizes {
+		unixfs = appendProtoVarint(unixfs, 4, uint64(n))
+	}
+
+	var b []byte
+	for i, link := range links {
+		pbLink := appendProtoBytes(nil, 1, cidBytes(link))
+		pbLink = appendProtoVarint(pbLink, 3, uint64(sizes[i]))
+		b = appendProtoBytes(b, 2, pbLink)
+	}
+
+	return appendProtoBytes(b, 1, unixfs)
+}
+
+// dagFixture is a file of two full chunks and a short one, laid out like
+// ipfs add --raw-leaves: raw leaves under a CIDv0 dag-pb root. It returns
+// the root CID, the file and every block by CID.
+func dagFixture() (string, []byte, map[string][]byte) {
+	var content []byte
+	blocks := make(map[string][]byte)
+	var links []*cidInfo
+	var sizes []int
+
+	for i, n := range []int{unixfsChunkSize, unixfsChunkSize, 100} {
+		leaf := bytes.Repeat([]byte{byte('a' + i)}, n)
+		content = append(content, leaf...)
+
+		c := blockCID(1, codecRaw, leaf)
+		blocks[c.String()] = leaf
+		links = append(links, c)
+		sizes = append(sizes, n)
+	}
+
+	root := dagPBNode(unixfsFile, links, sizes)
+	rootCID := blockCID(0, codecDagPB, root).String()
+	blocks[rootCID] = root
+
+	return rootCID, content, blocks
+}
+
+func TestVerifyContent(t *testing.T) {
+	root, content, _ := dagFixture()
+
+	tests := []struct {
+		name    string
+		cid     string
+		content string
+		ok      bool
+		is      error
+	}{
+		// What ipfs add prints for these files.
+		{"cidv0", "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o", "hello world\n", true, nil},
+		{"cidv0 empty file", "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH", "", true, nil},
+		{"raw leaf cidv1", "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", "hello world", true, nil},
+		{"cidv0 tampered", "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o", "hello world!\n", false, nil},
+		{"raw leaf tampered", "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", "hello World", false, nil},
+		{"several blocks", root, string(content), false, errUnverifiable},
+		{"bad cid", "Qmnotacid", "hello world\n", false, errBadCID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyContent(tt.cid, []byte(tt.content))
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Errorf("got %v, want %v", err, tt.is)
+			}
+			if tt.is == nil && errors.Is(err, errUnverifiable) {
+				t.Errorf("got %v, want a mismatch", err)
+			}
+		})
+	}
+}
+
+func TestDecodeDagPB(t *testing.T) {
+	leaf := blockCID(1, codecRaw, []byte("leaf"))
+	inner := blockCID(0, codecDagPB, unixfsFileBlock([]byte("inner")))
+	root := dagPBNode(unixfsFile, []*cidInfo{leaf, inner}, []int{4, 5})
+
+	badLink := appendProtoBytes(nil, 2, appendProtoBytes(nil, 1, []byte{0x01, 0x55}))
+	badLink = appendProtoBytes(badLink, 1, appendProtoVarint(nil, 1, unixfsFile))
+
+	tests := []struct {
+		name  string
+		block []byte
+		data  string
+		links []*cidInfo
+		ok    bool
+	}{
+		{"single block file", unixfsFileBlock([]byte("hello")), "hello", nil, true},
+		{"root of several blocks", root, "", []*cidInfo{leaf, inner}, true},
+		{"directory", dagPBNode(1, nil, nil), "", nil, false},
+		{"no unixfs data", appendProtoBytes(nil, 2, appendProtoBytes(nil, 1, cidBytes(leaf))), "", nil, false},
+		{"invalid link", badLink, "", nil, false},
+		{"truncated", root[:len(root)-3], "", nil, false},
+		{"empty", nil, "", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := decodeDagPB(tt.block)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", node)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(node.Data) != tt.data || len(node.Links) != len(tt.links) {
+				t.Fatalf("got data %q and %d links", node.Data, len(node.Links))
+			}
+			for i, link := range node.Links {
+				if link.String() != tt.links[i].String() {
+					t.Errorf("link %d is %s, want %s", i, link, tt.links[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Subcommands for operators. Without one the server runs, as it always has.
+
+var commands = map[string]func(*Config, []string) error{
+	"serve":     serve,
+	"export":    exportPosts,
+	"import":    importPosts,
+	"show-head": showHead,
+	"set-head":  setHeadCmd,
+	"migrate":   migrateHead,
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: diam_connect [command]
+
+commands:
+  serve                  run the server (default)
+  export [--cid CID]     write the posts of a feed head, or of the database, as JSON
+  import [--dry-run] F   validate the posts in file F ("-" for stdin), add them and publish a new head
+  show-head              print the current head CID
+  set-head CID           make CID the head and load its posts into the database
+  migrate [--dry-run]    upgrade the head document to the current schema and publish it
+
+The server holds the database, so commands that use it fail while it
+runs: only show-head, export --cid and the --dry-run of import and migrate
+work alongside it.
+`)
+}
+
+func exportPosts(app *Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	cid := fs.String("cid", "", "feed head to export instead of the database")
+	fs.Parse(args)
+
+	var posts []Post
+	var err error
+	if *cid != "" {
+		var feed []byte
+		feed, err = app.fetchFromIPFS(context.Background(), *cid)
+		if err != nil {
+			return err
+		}
+		posts, _, err = decodeFeed(feed)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = app.openDB()
+		if err != nil {
+			return fmt.Errorf("%w; export --cid $(diam_connect show-head) works while the server runs", err)
+		}
+		defer app.DB.Close()
+
+		posts, _, err = app.DB.Posts()
+		if err != nil {
+			return err
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(posts)
+}
+
+func importPosts(app *Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only validate the file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Exports and feed documents alike.
+	posts, _, err := decodeFeed(data)
+	if err != nil {
+		return err
+	}
+
+	err = validatePosts(posts)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "%d posts are valid\n", len(posts))
+		return nil
+	}
+
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+	defer app.DB.Close()
+
+	err = app.ensureHead(context.Background())
+	if err != nil {
+		return err
+	}
+
+	err = app.seedDB(context.Background())
+	if err != nil {
+		return fmt.Errorf("seeding database: %w", err)
+	}
+
+	var fresh []Post
+	for _, p := range posts {
+		_, err := app.DB.Post(p.Id)
+		if errors.Is(err, errPostNotFound) {
+			fresh = append(fresh, p)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "skipping post %s, which already exists\n", p.Id)
+	}
+
+	err = app.DB.InsertPosts(fresh)
+	if err != nil {
+		return err
+	}
+
+	head, err := app.snapshot()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d posts\n", len(fresh))
+	fmt.Println(head)
+	return nil
+}
+
+// validatePosts checks every post of an import and reports all problems at
+// once.
+func validatePosts(posts []Post) error {
+	var v ValidationError
+	seen := make(map[string]bool, len(posts))
+
+	for i, p := range posts {
+		field := "posts[" + strconv.Itoa(i) + "]."
+
+		v.required(field+"id", p.Id)
+		if p.Id != "" && !validPostID(p.Id) {
+			v.add(field+"id", CodeInvalidRequest, "must be a post id")
+		}
+		if p.Id != "" && seen[p.Id] {
+			v.add(field+"id", CodeInvalidRequest, "appears more than once")
+		}
+		seen[p.Id] = true
+
+		v.address(field+"user_address", p.UserAddress)
+
+		if p.Type < 0 || p.Type > 3 {
+			v.add(field+"type", CodeInvalidRequest, "must be 1, 2 or 3, or 0 for posts older than types")
+		}
+		if p.LikeCount < 0 {
+			v.add(field+"like_count", CodeInvalidRequest, "must not be negative")
+		}
+
+		for j, a := range p.Attachments {
+			if !validMediaKey(a.CID) {
+				v.add(field+"attachments["+strconv.Itoa(j)+"].cid", CodeInvalidRequest, "must be a CID or blob key")
+			}
+		}
+	}
+
+	return v.err()
+}
+
+// validMediaKey accepts the keys media are stored under by any BlobStore.
+func validMediaKey(key string) bool {
+	if validBlobKey(key) {
+		return true
+	}
+
+	_, err := parseCID(key)
+	return err == nil
+}
+
+func showHead(app *Config, args []string) error {
+	cid, err := ReadCIDFromFile()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(cid)
+	return nil
+}
+
+func setHeadCmd(app *Config, args []string) error {
+	if len(args) != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	cid := args[0]
+	_, err := parseCID(cid)
+	if err != nil {
+		return err
+	}
+
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+	defer app.DB.Close()
+
+	n, prev, err := app.loadHead(context.Background(), cid)
+	if err != nil {
+		return err
+	}
+
+	err = app.setHead(cid, prev)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "head is now %s with %d posts\n", cid, n)
+	return nil
+}
+
+func migrateHead(app *Config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only list the migrations the head needs")
+	fs.Parse(args)
+
+	head, err := ReadCIDFromFile()
+	if err != nil {
+		return err
+	}
+
+	feed, err := app.fetchFromIPFS(context.Background(), head)
+	if err != nil {
+		return err
+	}
+
+	version, _, _, err := parseFeed(feed)
+	if err != nil {
+		return err
+	}
+	if version == feedSchemaVersion {
+		fmt.Fprintf(os.Stderr, "head %s is at schema version %d\n", head, version)
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "head %s is at schema version %d; migrations:\n", head, version)
+	for _, name := range pendingMigrations(version) {
+		fmt.Fprintln(os.Stderr, "  "+name)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	// The database is not needed, but holding it keeps a running server
+	// from setting the head at the same time.
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+	defer app.DB.Close()
+
+	current, err := ReadCIDFromFile()
+	if err != nil {
+		return err
+	}
+	if current != head {
+		return fmt.Errorf("head moved from %s to %s, run migrate again", head, current)
+	}
+
+	posts, _, err := decodeFeed(feed)
+	if err != nil {
+		return err
+	}
+
+	cid, err := app.publishFeed(posts, head)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(cid)
+	return nil
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The database is the system of record for posts and their likes. Posts
+// are kept in the order they were created, keyed by a sequence number, with
+// indexes by post ID and by author. Every write bumps a version counter; a
+// background publisher snapshots the posts to IPFS as a new feed head
+// whenever the version moved past the last published one.
+
+var (
+	bucketPosts   = []byte("posts")
+	bucketPostIDs = []byte("post_ids")
+	bucketUsers   = []byte("users")
+	bucketMeta    = []byte("meta")
+	bucketRewards = []byte("rewards")
+
+	metaVersion   = []byte("version")
+	metaPublished = []byte("published")
+	metaSchema    = []byte("schema_version")
+
+	snapshotWake = make(chan struct{}, 1)
+)
+
+var errDuplicatePost = errors.New("a post with this id already exists")
+
+type DB struct {
+	bolt *bolt.DB
+}
+
+// Publication state of the database: the head that holds version.
+type Snapshot struct {
+	CID     string    `json:"cid"`
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+func OpenDB(path string) (*DB, error) {
+	b, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketPosts, bucketPostIDs, bucketUsers, bucketMeta, bucketRewards} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return migrateDB(tx)
+	})
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return &DB{bolt: b}, nil
+}
+
+// migrateDB upgrades the stored posts to the current schema. Databases from
+// before the schema was recorded hold posts of version 1.
+func migrateDB(tx *bolt.Tx) error {
+	meta := tx.Bucket(bucketMeta)
+	posts := tx.Bucket(bucketPosts)
+
+	from := feedSchemaVersion
+	if v := meta.Get(metaSchema); len(v) == 8 {
+		from = int(binary.BigEndian.Uint64(v))
+	} else if posts.Stats().KeyN > 0 {
+		from = 1
+	}
+
+	if from < feedSchemaVersion {
+		var keys, list [][]byte
+		err := posts.ForEach(func(k, data []byte) error {
+			keys = append(keys, k)
+			list = append(list, data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var upgraded []json.RawMessage
+		raw, err := migratePosts(append(append([]byte("["), bytes.Join(list, []byte(","))...), ']'), from)
+		if err == nil {
+			err = json.Unmarshal(raw, &upgraded)
+		}
+		if err != nil {
+			return fmt.Errorf("migrating database: %w", err)
+		}
+
+		// Every stored post already has an id, so the indexes stay valid.
+		for i, k := range keys {
+			err = posts.Put(k, upgraded[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Printf("migrated %d posts in the database from schema version %d to %d", len(keys), from, feedSchemaVersion)
+		err = bumpVersion(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return meta.Put(metaSchema, binary.BigEndian.AppendUint64(nil, uint64(feedSchemaVersion)))
+}
+
+func (db *DB) Close() error {
+	return db.bolt.Close()
+}
+
+func userKey(address string, seq []byte) []byte {
+	return append([]byte(address+"/"), seq...)
+}
+
+// bumpVersion marks the database as changed since the last snapshot.
+func bumpVersion(tx *bolt.Tx) error {
+	meta := tx.Bucket(bucketMeta)
+	return meta.Put(metaVersion, binary.BigEndian.AppendUint64(nil, version(tx)+1))
+}
+
+func version(tx *bolt.Tx) uint64 {
+	v := tx.Bucket(bucketMeta).Get(metaVersion)
+	if len(v) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(v)
+}
+
+// InsertPost adds a post after all existing ones.
+func (db *DB) InsertPost(p Post) error {
+	return db.InsertPosts([]Post{p})
+}
+
+// InsertPosts adds posts after all existing ones, in order. Either all of
+// them are added or, if one of the IDs is taken, none.
+func (db *DB) InsertPosts(list []Post) error {
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		for _, p := range list {
+			err := insertPost(tx, p)
+			if err != nil {
+				return fmt.Errorf("post %s: %w", p.Id, err)
+			}
+		}
+		return bumpVersion(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	wakeSnapshots()
+	return nil
+}
+
+func insertPost(tx *bolt.Tx, p Post) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	ids := tx.Bucket(bucketPostIDs)
+	if ids.Get([]byte(p.Id)) != nil {
+		return errDuplicatePost
+	}
+
+	posts := tx.Bucket(bucketPosts)
+	n, err := posts.NextSequence()
+	if err != nil {
+		return err
+	}
+	seq := binary.BigEndian.AppendUint64(nil, n)
+
+	err = posts.Put(seq, data)
+	if err != nil {
+		return err
+	}
+	err = ids.Put([]byte(p.Id), seq)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketUsers).Put(userKey(p.UserAddress, seq), nil)
+}
+
+// ReplacePosts swaps every post for list and records head as the snapshot
+// that holds exactly these posts.
+func (db *DB) ReplacePosts(list []Post, head string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketPosts, bucketPostIDs, bucketUsers} {
+			err := tx.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, p := range list {
+			err := insertPost(tx, p)
+			if err != nil {
+				return fmt.Errorf("post %s: %w", p.Id, err)
+			}
+		}
+
+		err := bumpVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(Snapshot{CID: head, Version: version(tx), Time: time.Now()})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketMeta).Put(metaPublished, data)
+	})
+}
+
+// Post returns the post with the given ID.
+func (db *DB) Post(id string) (*Post, error) {
+	var p Post
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		seq := tx.Bucket(bucketPostIDs).Get([]byte(id))
+		if seq == nil {
+			return errPostNotFound
+		}
+		return json.Unmarshal(tx.Bucket(bucketPosts).Get(seq), &p)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// updatePost applies fn to a post and stores the result. The author and ID
+// of a post cannot change.
+func updatePost(tx *bolt.Tx, id string, fn func(*Post) error) error {
+	seq := tx.Bucket(bucketPostIDs).Get([]byte(id))
+	if seq == nil {
+		return errPostNotFound
+	}
+
+	posts := tx.Bucket(bucketPosts)
+	var p Post
+	err := json.Unmarshal(posts.Get(seq), &p)
+	if err != nil {
+		return err
+	}
+
+	ua := p.UserAddress
+	err = fn(&p)
+	if err != nil {
+		return err
+	}
+	p.Id, p.UserAddress = id, ua
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	err = posts.Put(seq, data)
+	if err != nil {
+		return err
+	}
+
+	return bumpVersion(tx)
+}
+
+// LikePost adds (delta 1) or takes back (delta -1) the like of liker. A
+// like that brings the post up to threshold queues its reward in the same
+// transaction, unless the post has had one queued before, so racing likes
+// and liking again after an unlike cannot pay it twice. It reports whether
+// a reward was queued.
+func (db *DB) LikePost(id, liker string, delta, threshold int) (bool, error) {
+	queued := false
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		var post Post
+		err := updatePost(tx, id, func(p *Post) error {
+			switch {
+			case delta > 0 && p.LikedBy(liker):
+				return errAlreadyLiked
+			case delta < 0 && !p.LikedBy(liker):
+				return errNotLiked
+			}
+
+			if p.Likers == nil {
+				p.Likers = make(map[string]int)
+			}
+			if delta > 0 {
+				p.Likers[liker] = 1
+			} else {
+				delete(p.Likers, liker)
+			}
+			p.LikeCount += delta
+
+			post = *p
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		rewards := tx.Bucket(bucketRewards)
+		if delta < 0 || post.LikeCount != threshold || rewards.Get([]byte(id)) != nil {
+			return nil
+		}
+
+		now := time.Now()
+		data, err := json.Marshal(Reward{
+			PostID:      id,
+			Status:      rewardDue,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		})
+		if err != nil {
+			return err
+		}
+		queued = true
+		return rewards.Put([]byte(id), data)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	wakeSnapshots()
+	return queued, nil
+}
+
+// Rewards returns every reward, paid or not.
+func (db *DB) Rewards() ([]Reward, error) {
+	list := []Reward{}
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRewards).ForEach(func(_, data []byte) error {
+			var r Reward
+			err := json.Unmarshal(data, &r)
+			if err != nil {
+				return err
+			}
+			list = append(list, r)
+			return nil
+		})
+	})
+
+	return list, err
+}
+
+// PutReward stores the state of a reward.
+func (db *DB) PutReward(r Reward) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRewards).Put([]byte(r.PostID), data)
+	})
+}
+
+// PostsByUser returns the posts of address, oldest first.
+func (db *DB) PostsByUser(address string) ([]Post, error) {
+	var list [][]byte
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		posts := tx.Bucket(bucketPosts)
+		prefix := []byte(address + "/")
+
+		c := tx.Bucket(bucketUsers).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if data := posts.Get(k[len(prefix):]); data != nil {
+				list = append(list, data)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeList(list)
+}
+
+// Posts returns every post, oldest first, and the version of the database
+// they were read at.
+func (db *DB) Posts() ([]Post, uint64, error) {
+	var list [][]byte
+	var v uint64
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		v = version(tx)
+		return tx.Bucket(bucketPosts).ForEach(func(_, data []byte) error {
+			list = append(list, data)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	posts, err := decodeList(list)
+	return posts, v, err
+}
+
+func decodeList(list [][]byte) ([]Post, error) {
+	posts := make([]Post, 0, len(list))
+	for _, data := range list {
+		var p Post
+		err := json.Unmarshal(data, &p)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+
+	return posts, nil
+}
+
+// Count returns the number of posts.
+func (db *DB) Count() (int, error) {
+	n := 0
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucketPosts).Stats().KeyN
+		return nil
+	})
+
+	return n, err
+}
+
+// Published returns the last snapshot, or a zero Snapshot if there is none.
+func (db *DB) Published() (Snapshot, error) {
+	var s Snapshot
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMeta).Get(metaPublished)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &s)
+	})
+
+	return s, err
+}
+
+func (db *DB) SetPublished(s Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put(metaPublished, data)
+	})
+}
+
+// Version returns the current version of the database.
+func (db *DB) Version() (uint64, error) {
+	var v uint64
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		v = version(tx)
+		return nil
+	})
+
+	return v, err
+}
+
+func wakeSnapshots() {
+	select {
+	case snapshotWake <- struct{}{}:
+	default:
+	}
+}
+
+// seedDB fills an empty database from the current feed head, so switching
+// to the database does not lose the posts published before it. Nothing may
+// be written to an empty database before this succeeds: the next snapshot
+// would replace the feed with only the new posts.
+func (app *Config) seedDB(ctx context.Context) error {
+	n, err := app.DB.Count()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	head, err := ReadCIDFromFile()
+	if errors.Is(err, os.ErrNotExist) {
+		// A new installation (see ensureHead); the first snapshot starts
+		// the feed.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	n, _, err = app.loadHead(ctx, head)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("seeded database with %d posts from %s", n, head)
+	return nil
+}
+
+// loadHead makes the database hold exactly the posts of the feed at head.
+// It returns how many posts that is and the head before it.
+func (app *Config) loadHead(ctx context.Context, head string) (int, string, error) {
+	feed, err := app.fetchFromIPFS(ctx, head)
+	if err != nil {
+		return 0, "", err
+	}
+
+	posts, prev, err := decodeFeed(feed)
+	if err != nil {
+		return 0, "", err
+	}
+
+	seen := make(map[string]bool, len(posts))
+	unique := posts[:0]
+	for _, p := range posts {
+		if seen[p.Id] {
+			log.Printf("head %s: skipping duplicate post %s", head, p.Id)
+			continue
+		}
+		seen[p.Id] = true
+		unique = append(unique, p)
+	}
+
+	return len(unique), prev, app.DB.ReplacePosts(unique, head)
+}
+
+// runSnapshots publishes the database to IPFS until ctx is cancelled. A
+// burst of writes is published as one snapshot, at most every interval.
+func (app *Config) runSnapshots(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-snapshotWake:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+
+		_, err := app.snapshot()
+		if err != nil {
+			log.Println("snapshot:", err)
+		}
+	}
+}
+
+// snapshot publishes the posts as a new feed head if anything changed since
+// the last snapshot, and returns the head that holds the current state.
+func (app *Config) snapshot() (string, error) {
+	published, err := app.DB.Published()
+	if err != nil {
+		return "", err
+	}
+
+	posts, v, err := app.DB.Posts()
+	if err != nil {
+		return "", err
+	}
+	if published.CID != "" && v == published.Version {
+		return published.CID, nil
+	}
+	if published.CID == "" && len(posts) == 0 {
+		// Nothing was ever published or written: an empty first feed
+		// would only replace one this server failed to find.
+		return "", nil
+	}
+
+	prev, _ := ReadCIDFromFile()
+	cid, err := app.publishFeed(posts, prev)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.DB.SetPublished(Snapshot{CID: cid, Version: v, Time: time.Now()})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("published snapshot %s of version %d (%d posts)", cid, v, len(posts))
+	return cid, nil
+}
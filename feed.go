@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// Feed is the root document the head CID points at. Prev links every head
+// to the one it replaced, so the history of the feed can be walked from any
+// head and two heads can be compared by how much history they carry. Heads
+// written before the link existed are bare arrays of posts.
+type Feed struct {
+	SchemaVersion int             `json:"schema_version"`
+	Prev          string          `json:"prev,omitempty"`
+	Posts         json.RawMessage `json:"posts"`
+}
+
+// parseFeed splits a root document into its schema version, the CID of the
+// previous head and the posts, which are still in the document's schema.
+func parseFeed(data []byte) (int, string, json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		return 0, "", data, nil
+	}
+
+	var feed Feed
+	err := json.Unmarshal(data, &feed)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if feed.Posts == nil {
+		return 0, "", nil, errors.New("feed document has no posts")
+	}
+
+	// Documents with prev came before schema_version.
+	if feed.SchemaVersion == 0 {
+		feed.SchemaVersion = 1
+	}
+
+	return feed.SchemaVersion, feed.Prev, feed.Posts, nil
+}
+
+// decodeFeed returns the posts of a root document, upgraded to the current
+// schema, and the CID of the previous head.
+func decodeFeed(data []byte) ([]Post, string, error) {
+	version, prev, raw, err := parseFeed(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	raw, err = migratePosts(raw, version)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var posts []Post
+	err = json.Unmarshal(raw, &posts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return posts, prev, nil
+}
+
+// publishFeed uploads posts as the new root document after prev and makes
+// it the head.
+func (app *Config) publishFeed(posts []Post, prev string) (string, error) {
+	if posts == nil {
+		posts = []Post{}
+	}
+
+	encoded, err := json.Marshal(posts)
+	if err != nil {
+		return "", err
+	}
+
+	root, err := json.Marshal(Feed{SchemaVersion: feedSchemaVersion, Prev: prev, Posts: encoded})
+	if err != nil {
+		return "", err
+	}
+
+	// Roots go to the same node as media, pins and IPNS, whatever the
+	// primary BlobStore is.
+	store := &IPFSStore{Node: app.IPFSNode}
+	cid, err := store.Put(context.Background(), bytes.NewReader(root))
+	if err != nil {
+		return "", apiError(CodeIPFSUnavailable, err)
+	}
+
+	return cid, app.setHead(cid, prev)
+}
+
+// setHead records cid as the head, following prev.
+func (app *Config) setHead(cid, prev string) error {
+	err := WriteCIDToFile(cid)
+	if err != nil {
+		return err
+	}
+
+	err = appendJournal(cid, prev)
+	if err != nil {
+		// The journal is only a recovery aid.
+		log.Printf("head %s: could not write journal: %v", cid, err)
+	}
+
+	app.headChanged(cid)
+	return nil
+}
+
+// JournalEntry is one line of the head journal, which lists every head
+// this server has set, oldest first.
+type JournalEntry struct {
+	CID  string    `json:"cid"`
+	Prev string    `json:"prev,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+func journalFile() string {
+	return envOr("HEAD_JOURNAL_FILE", "head_journal.jsonl")
+}
+
+func appendJournal(cid, prev string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	file, err := os.OpenFile(journalFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(JournalEntry{CID: cid, Prev: prev, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// readJournal returns the journal entries, skipping lines that cannot be
+// decoded, e.g. one cut short by a crash.
+func readJournal() ([]JournalEntry, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	file, err := os.Open(journalFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e JournalEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.CID != "" {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, scanner.Err()
+}
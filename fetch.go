@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// GatewayClient reads content from several sources: the configured public
+// gateways and, optionally, the local node. It either races all
+// healthy sources or tries them one after another, fastest first. A source
+// that fails, times out or returns bytes that do not match the CID is
+// backed off for a while.
+
+const (
+	readStrategyRace     = "race"
+	readStrategyFallback = "fallback"
+
+	localSource = "local"
+
+	// maxFetchBytes bounds what one read may return.
+	maxFetchBytes = 256 << 20
+
+	sourceMinBackoff = 5 * time.Second
+	sourceMaxBackoff = 5 * time.Minute
+)
+
+type GatewayClient struct {
+	Gateways []string
+	// Node is the IPFS API used for cat; empty disables it.
+	Node     string
+	Strategy string
+	Timeout  time.Duration
+	HTTP     *http.Client
+
+	mu     sync.Mutex
+	health map[string]*SourceHealth
+}
+
+// SourceHealth is what the client has learned about one source.
+type SourceHealth struct {
+	Source    string        `json:"source"`
+	Successes int           `json:"successes"`
+	Failures  int           `json:"failures"`
+	Latency   time.Duration `json:"latency_ns"`
+	LastError string        `json:"last_error,omitempty"`
+	DownUntil time.Time     `json:"down_until,omitempty"`
+}
+
+func NewGatewayClient(gateways []string, node, strategy string, timeout time.Duration) *GatewayClient {
+	if strategy != readStrategyFallback {
+		strategy = readStrategyRace
+	}
+
+	return &GatewayClient{
+		Gateways: gateways,
+		Node:     node,
+		Strategy: strategy,
+		Timeout:  timeout,
+		HTTP:     &http.Client{},
+		health:   make(map[string]*SourceHealth),
+	}
+}
+
+func (c *GatewayClient) sources() []string {
+	var sources []string
+	if c.Node != "" {
+		sources = append(sources, localSource)
+	}
+
+	return append(sources, c.Gateways...)
+}
+
+// ordered lists the sources that are not backed off, fastest first. When
+// every source is backed off all of them are tried rather than none.
+func (c *GatewayClient) ordered() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var up, down []string
+	for _, s := range c.sources() {
+		if h := c.health[s]; h != nil && time.Now().Before(h.DownUntil) {
+			down = append(down, s)
+		} else {
+			up = append(up, s)
+		}
+	}
+
+	sort.SliceStable(up, func(i, j int) bool {
+		return c.latency(up[i]) < c.latency(up[j])
+	})
+
+	if len(up) == 0 {
+		return down
+	}
+
+	return up
+}
+
+// latency is the smoothed latency of a source; unknown sources sort as
+// fast so they get tried.
+func (c *GatewayClient) latency(source string) time.Duration {
+	if h := c.health[source]; h != nil {
+		return h.Latency
+	}
+
+	return 0
+}
+
+func (c *GatewayClient) record(source string, took time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h := c.health[source]
+	if h == nil {
+		h = &SourceHealth{Source: source}
+		c.health[source] = h
+	}
+
+	if err == nil {
+		h.Successes++
+		h.Failures = 0
+		h.LastError = ""
+		h.DownUntil = time.Time{}
+		if h.Latency == 0 {
+			h.Latency = took
+		} else {
+			h.Latency = (h.Latency*4 + took) / 5
+		}
+		return
+	}
+
+	if errors.Is(err, context.Canceled) {
+		// Lost a race; says nothing about the source.
+		return
+	}
+
+	h.Failures++
+	h.LastError = err.Error()
+	backoff := sourceMinBackoff << min(h.Failures-1, 16)
+	if backoff > sourceMaxBackoff {
+		backoff = sourceMaxBackoff
+	}
+	h.DownUntil = time.Now().Add(backoff)
+}
+
+// Health returns a snapshot of every source.
+func (c *GatewayClient) Health() []SourceHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]SourceHealth, 0, len(c.health))
+	for _, s := range c.sources() {
+		if h := c.health[s]; h != nil {
+			out = append(out, *h)
+		} else {
+			out = append(out, SourceHealth{Source: s})
+		}
+	}
+
+	return out
+}
+
+// Fetch returns the content of cid from the first source that delivers
+// verified bytes.
+func (c *GatewayClient) Fetch(ctx context.Context, cid string) ([]byte, error) {
+	_, err := parseCID(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := c.ordered()
+	if len(sources) == 0 {
+		return nil, errors.New("no IPFS sources configured")
+	}
+
+	if c.Strategy == readStrategyFallback {
+		var errs []error
+		for _, s := range sources {
+			data, err := c.fetchFrom(ctx, s, cid)
+			if err == nil {
+				return data, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	return c.race(ctx, sources, cid)
+}
+
+func (c *GatewayClient) race(ctx context.Context, sources []string, cid string) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	results := make(chan result, len(sources))
+	for _, s := range sources {
+		go func(s string) {
+			data, err := c.fetchFrom(ctx, s, cid)
+			results <- result{data, err}
+		}(s)
+	}
+
+	var errs []error
+	for range sources {
+		r := <-results
+		if r.err == nil {
+			return r.data, nil
+		}
+		errs = append(errs, r.err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// fetchFrom reads cid from one source within the timeout. The content is
+// assembled from blocks that are each checked against their CID, so a
+// source cannot slip in bytes that do not belong to the file. Gateways that
+// cannot serve raw blocks only get to answer for files that fit in a
+// single block, which can be checked whole.
+func (c *GatewayClient) fetchFrom(ctx context.Context, source, cid string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	data, err := c.readDAG(ctx, source, cid)
+	if errors.Is(err, errNoRawBlocks) {
+		data, err = c.read(ctx, source, cid)
+		if err == nil {
+			err = verifyContent(cid, data)
+		}
+		if errors.Is(err, errUnverifiable) {
+			err = fmt.Errorf("%w and %w", err, errNoRawBlocks)
+		}
+	}
+	c.record(source, time.Since(start), err)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+
+	return data, nil
+}
+
+const (
+	// maxBlockBytes is well above the block size any IPFS node produces.
+	maxBlockBytes = 2 << 20
+	maxDAGDepth   = 32
+
+	rawBlockType = "application/vnd.ipld.raw"
+)
+
+var errNoRawBlocks = errors.New("source does not serve raw blocks")
+
+// readDAG reads the UnixFS file cid one block at a time, verifying every
+// block before it is decoded.
+func (c *GatewayClient) readDAG(ctx context.Context, source, cid string) ([]byte, error) {
+	root, err := parseCID(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	err = c.appendDAG(ctx, source, root, 0, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (c *GatewayClient) appendDAG(ctx context.Context, source string, node *cidInfo, depth int, out *[]byte) error {
+	if depth > maxDAGDepth {
+		return fmt.Errorf("%w: DAG deeper than %d", errBadBlock, maxDAGDepth)
+	}
+
+	block, err := c.readBlock(ctx, source, node.String())
+	if err != nil {
+		return err
+	}
+	if !node.matchesBlock(block) {
+		return fmt.Errorf("block %s does not match its CID", node)
+	}
+
+	switch node.Codec {
+	case codecRaw:
+		*out = append(*out, block...)
+	case codecDagPB:
+		dag, err := decodeDagPB(block)
+		if err != nil {
+			return err
+		}
+		*out = append(*out, dag.Data...)
+		for _, link := range dag.Links {
+			if len(*out) > maxFetchBytes {
+				break
+			}
+			err = c.appendDAG(ctx, source, link, depth+1, out)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unsupported codec 0x%x", errBadCID, node.Codec)
+	}
+
+	if len(*out) > maxFetchBytes {
+		return fmt.Errorf("content is larger than %s", formatBytes(maxFetchBytes))
+	}
+
+	return nil
+}
+
+// readBlock reads one raw block: block/get on the local node, a trustless
+// gateway request elsewhere.
+func (c *GatewayClient) readBlock(ctx context.Context, source, cid string) ([]byte, error) {
+	var body io.ReadCloser
+
+	if source == localSource {
+		res, err := shell.NewShell(c.Node).Request("block/get", cid).Send(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if res.Error != nil {
+			res.Close()
+			return nil, res.Error
+		}
+		body = res.Output
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source+"/ipfs/"+cid+"?format=raw", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", rawBlockType)
+
+		res, err := c.HTTP.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case res.StatusCode == http.StatusBadRequest || res.StatusCode == http.StatusNotAcceptable:
+			res.Body.Close()
+			return nil, errNoRawBlocks
+		case res.StatusCode != http.StatusOK:
+			res.Body.Close()
+			return nil, fmt.Errorf("gateway answered %s", res.Status)
+		case !strings.HasPrefix(res.Header.Get("Content-Type"), rawBlockType):
+			// An older gateway ignoring the format and sending the file.
+			res.Body.Close()
+			return nil, errNoRawBlocks
+		}
+		body = res.Body
+	}
+	defer body.Close()
+
+	return readLimited(body, maxBlockBytes)
+}
+
+// read fetches the whole file cid from one source.
+func (c *GatewayClient) read(ctx context.Context, source, cid string) ([]byte, error) {
+	var body io.ReadCloser
+
+	if source == localSource {
+		res, err := shell.NewShell(c.Node).Request("cat", cid).Send(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if res.Error != nil {
+			res.Close()
+			return nil, res.Error
+		}
+		body = res.Output
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source+"/ipfs/"+cid, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := c.HTTP.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("gateway answered %s", res.Status)
+		}
+		body = res.Body
+	}
+	defer body.Close()
+
+	return readLimited(body, maxFetchBytes)
+}
+
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("content is larger than %s", formatBytes(int64(limit)))
+	}
+
+	return data, nil
+}
+
+// fetchFromIPFS reads the feed document cid through the gateway client.
+func (app *Config) fetchFromIPFS(ctx context.Context, cid string) ([]byte, error) {
+	data, err := app.Reader.Fetch(ctx, cid)
+	if err != nil {
+		log.Printf("fetching %s: %v", cid, err)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (app *Config) gatewayHealth(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: app.Reader.Strategy,
+		Data:    app.Reader.Health(),
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGateway serves blocks by CID. With raw set it answers ?format=raw
+// with the block itself, as a trustless gateway does; without it, it
+// ignores the format and sends the whole file, as older gateways do.
+type fakeGateway struct {
+	raw    bool
+	blocks map[string][]byte
+	files  map[string][]byte
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cid := strings.TrimPrefix(r.URL.Path, "/ipfs/")
+
+	if g.raw && r.URL.Query().Get("format") == "raw" {
+		block, ok := g.blocks[cid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", rawBlockType)
+		w.Write(block)
+		return
+	}
+
+	file, ok := g.files[cid]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(file)
+}
+
+func newTestGateway(t *testing.T, g *fakeGateway) (*GatewayClient, string) {
+	srv := httptest.NewServer(g)
+	t.Cleanup(srv.Close)
+
+	c := NewGatewayClient([]string{srv.URL}, "", readStrategyFallback, 5*time.Second)
+	c.HTTP = srv.Client()
+	return c, srv.URL
+}
+
+func TestReadDAG(t *testing.T) {
+	root, content, blocks := dagFixture()
+
+	tampered := make(map[string][]byte)
+	for cid, block := range blocks {
+		tampered[cid] = block
+	}
+	leaf := blockCID(1, codecRaw, content[unixfsChunkSize:2*unixfsChunkSize]).String()
+	tampered[leaf] = append([]byte("x"), blocks[leaf][1:]...)
+
+	single := unixfsFileBlock([]byte("hello world\n"))
+	singleCID := blockCID(0, codecDagPB, single).String()
+	blocks[singleCID] = single
+
+	tests := []struct {
+		name    string
+		blocks  map[string][]byte
+		cid     string
+		content []byte
+		ok      bool
+	}{
+		{"several blocks", blocks, root, content, true},
+		{"single block", blocks, singleCID, []byte("hello world\n"), true},
+		{"tampered leaf", tampered, root, nil, false},
+		{"missing leaf", map[string][]byte{root: blocks[root]}, root, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, source := newTestGateway(t, &fakeGateway{raw: true, blocks: tt.blocks})
+
+			data, err := c.readDAG(context.Background(), source, tt.cid)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(tt.content) {
+				t.Errorf("got %d bytes, want %d", len(data), len(tt.content))
+			}
+		})
+	}
+}
+
+func TestFetchFromWithoutRawBlocks(t *testing.T) {
+	root, content, _ := dagFixture()
+	single := "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"
+
+	tests := []struct {
+		name string
+		cid  string
+		file string
+		ok   bool
+	}{
+		{"single chunk", single, "hello world\n", true},
+		{"single chunk tampered", single, "hello world!\n", false},
+		// Nothing short of the blocks can show this is the file.
+		{"several chunks", root, string(content), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, source := newTestGateway(t, &fakeGateway{files: map[string][]byte{tt.cid: []byte(tt.file)}})
+
+			data, err := c.fetchFrom(context.Background(), source, tt.cid)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if len(tt.file) > unixfsChunkSize && !errors.Is(err, errNoRawBlocks) {
+					t.Errorf("got %v, want %v", err, errNoRawBlocks)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.file {
+				t.Errorf("got %q, want %q", data, tt.file)
+			}
+		})
+	}
+}
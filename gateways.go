@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+)
+
+// Post records store bare CIDs. Gateway URLs are rendered when a post is
+// served, from IPFS_GATEWAYS in order of preference, so moving to another
+// gateway never means rewriting the feed.
+
+const defaultGateway = "https://browseipfs.diamcircle.io"
+
+// parseGateways splits a comma separated list of gateway base URLs.
+func parseGateways(list string) []string {
+	var gateways []string
+	for _, g := range strings.Split(list, ",") {
+		g = strings.TrimRight(strings.TrimSpace(g), "/")
+		if g != "" {
+			gateways = append(gateways, g)
+		}
+	}
+
+	if len(gateways) == 0 {
+		return []string{defaultGateway}
+	}
+
+	return gateways
+}
+
+// gatewayURL is the URL of cid on the preferred gateway.
+func (app *Config) gatewayURL(cid string) string {
+	if cid == "" {
+		return ""
+	}
+
+	return app.Gateways[0] + "/ipfs/" + cid
+}
+
+// gatewayURLs lists the URL of cid on every configured gateway.
+func (app *Config) gatewayURLs(cid string) []string {
+	urls := make([]string, len(app.Gateways))
+	for i, g := range app.Gateways {
+		urls[i] = g + "/ipfs/" + cid
+	}
+
+	return urls
+}
+
+// bareCID strips a gateway URL, /ipfs/ path or ipfs:// scheme from ref.
+// Posts written before records held bare CIDs store full URLs.
+func bareCID(ref string) string {
+	if i := strings.LastIndex(ref, "/ipfs/"); i >= 0 {
+		ref = ref[i+len("/ipfs/"):]
+	}
+	ref = strings.TrimPrefix(ref, "ipfs://")
+
+	if i := strings.IndexAny(ref, "/?#"); i >= 0 {
+		ref = ref[:i]
+	}
+
+	return ref
+}
+
+// renderPost replaces the CIDs of a post being served with gateway URLs.
+// image_hash keeps holding a URL, as it always has; attachments keep their
+// CID and list a URL per gateway.
+func (app *Config) renderPost(p *PostV1) {
+	p.ImageHash = app.gatewayURL(p.ImageHash)
+
+	for i := range p.Attachments {
+		a := &p.Attachments[i]
+		a.URLs = app.gatewayURLs(a.CID)
+		variants := make(map[string]string, len(a.Variants))
+		for name, cid := range a.Variants {
+			variants[name] = app.gatewayURL(cid)
+		}
+		if a.Variants != nil {
+			a.Variants = variants
+		}
+		a.Poster = app.gatewayURL(a.Poster)
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/go-chi/cors v1.2.1
 	github.com/ipfs/go-ipfs-api v0.7.0
 	github.com/stellar/go v0.0.0-20240430212000-9808f37f9f76
+	go.etcd.io/bbolt v1.3.10
 )
 
 require (
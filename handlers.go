@@ -1,25 +1,17 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
 	"time"
-
-	"github.com/diamcircle/go/clients/auroraclient"
-	"github.com/diamcircle/go/keypair"
-	"github.com/diamcircle/go/network"
-	"github.com/diamcircle/go/txnbuild"
-	shell "github.com/ipfs/go-ipfs-api"
 )
 
 var (
@@ -38,34 +30,13 @@ type UploadRequest struct {
 	LikeCount   int64     `json:"like_count"`
 }
 
-type MetadataResponse struct {
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	UserAddress string    `json:"user_address"`
-	Time        time.Time `json:"time"`
-	LikeCount   int64     `json:"like_count"`
-	ImageHash   string    `json:"image_hash"`
-	Type        int       `json:"type"`
-}
-
 type CIDData struct {
 	CID string `json:"CID"`
 }
 
 type RequestPayload struct {
-	UserAddress string `json:"user_address"`
-}
-
-type IPFSData struct {
-	Description string         `json:"description"`
-	IH          string         `json:"image_hash"`
-	Likes       int            `json:"like_count"`
-	Name        string         `json:"name"`
-	Time        time.Time      `json:"time"`
-	UA          string         `json:"user_address"`
-	Id          string         `json:"id"`
-	Type        int            `json:"type"`
-	Mapping     map[string]int `json:"mapping"`
+	UserAddress   string `json:"user_address"`
+	ViewerAddress string `json:"viewer_address"`
 }
 
 type HashRequest struct {
@@ -81,224 +52,240 @@ func (app *Config) Check(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusAccepted, payload)
 }
 
-func uploadData(token string, uid string, file multipart.File, fileName string) error {
-	url := "http://10.0.0.15:3001/v1/upload-data"
+// maxFieldBytes caps each non-file form field of an upload.
+const maxFieldBytes = 64 << 10
 
-	payload := new(bytes.Buffer)
-	writer := multipart.NewWriter(payload)
-	_ = writer.WriteField("uid", uid)
-	part, err := writer.CreateFormFile("files", fileName)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return err
+// bodyError reports hitting the request body limit as the file being too
+// large; it surfaces as a read error wherever the body is read.
+func (app *Config) bodyError(err error, mediaType string) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return errMediaTooLarge(app.uploadLimit(mediaType))
 	}
-	writer.Close()
 
-	req, err := http.NewRequest("POST", url, payload)
-	if err != nil {
-		return err
-	}
-
-	req.Header.Add("Accept", "*/*")
-	req.Header.Add("User-Agent", "Thunder Client (https://www.thunderclient.com)")
-	req.Header.Add("Authorization", "Bearer "+token)
-	req.Header.Add("Content-Type", writer.FormDataContentType())
+	return err
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
+// clientReader tags errors reading the request body as the client's, so a
+// cut-off upload is not reported as a server failure.
+type clientReader struct {
+	r io.Reader
+}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
+func (c clientReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = apiError(CodeInvalidRequest, err)
 	}
 
-	fmt.Println(res)
-	fmt.Println(string(body))
-
-	return nil
+	return n, err
 }
 
 func (app *Config) Upload(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(32 << 20)
-	if err != nil {
-		app.errorJSON(w, errors.New("file size should be less than 32mb"))
-		return
-	}
-
-	userAddress := r.FormValue("user_address")
-	if userAddress == "" {
-		app.errorJSON(w, errors.New("Invalid user address"))
-		return
-	}
+	r.Body = http.MaxBytesReader(w, r.Body, app.uploadLimit("")*int64(app.MaxAttachments)+1<<20)
 
-	mediaType := r.FormValue("media_type")
-	if mediaType == "" {
-		app.errorJSON(w, errors.New("Invalid media type"))
-		return
-	}
-
-	file, fileHeader, err := r.FormFile("image")
-	if file == nil && r.FormValue("desc") == "" {
-		app.errorJSON(w, errors.New("Request must contain either media or text"))
+	mr, err := r.MultipartReader()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 
-	if err != nil && err.Error() != "http: no such file" {
-		app.errorJSON(w, errors.New("error processing file"))
-		return
-	}
-	var imageHash string = ""
+	// Files are stored as they arrive, so user_address and media_type must
+	// come before them and are checked first; other fields may come in any
+	// order. Every "image" part is one attachment, in order.
+	fields := make(map[string]string)
+	var media []*storedMedia
+	defer func() {
+		for _, m := range media {
+			m.Close()
+		}
+	}()
 
-	if file != nil {
-		defer file.Close()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			app.errorJSON(w, app.bodyError(err, fields["media_type"]), http.StatusBadRequest)
+			return
+		}
 
-		log.Println("start")
+		if part.FormName() == "image" && part.FileName() != "" {
+			if len(media) == app.MaxAttachments {
+				part.Close()
+				app.errorJSON(w, apiErrorf(CodeInvalidRequest, "at most %d files may be uploaded", app.MaxAttachments))
+				return
+			}
+			if len(media) == 0 {
+				if err := checkUploadFields(fields); err != nil {
+					part.Close()
+					app.errorJSON(w, err)
+					return
+				}
+			}
 
-		sh := shell.NewShell("https://uploadipfs.diamcircle.io")
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(file)
-		log.Println("check")
+			m, err := app.storeMedia(r.Context(), clientReader{part}, part.FileName(), fields["media_type"])
+			part.Close()
+			if err != nil {
+				app.errorJSON(w, app.bodyError(err, fields["media_type"]))
+				return
+			}
+			media = append(media, m)
+			continue
+		}
 
-		imageHash, err = sh.Add(buf)
+		value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes))
+		part.Close()
 		if err != nil {
-			log.Println(err)
-			app.errorJSON(w, errors.New("error adding image to IPFS"))
+			app.errorJSON(w, app.bodyError(err, fields["media_type"]), http.StatusBadRequest)
 			return
 		}
-		log.Println("done")
-
-		imageHash = "https://browseipfs.diamcircle.io/ipfs/" + imageHash
+		fields[part.FormName()] = string(value)
 	}
 
-	var _type int
+	userAddress := fields["user_address"]
+	mediaType := fields["media_type"]
 
-	switch mediaType {
-	case "1":
-		_type = 1
-	case "2":
-		_type = 2
-	case "3":
-		_type = 3
-	default:
-		app.errorJSON(w, errors.New("Invalid media type"))
+	var v ValidationError
+	v.address("user_address", userAddress)
+	v.required("media_type", mediaType)
+	if err := v.err(); err != nil {
+		app.errorJSON(w, err)
 		return
 	}
 
-	metadata := IPFSData{
-		Name:        "",
-		Description: r.FormValue("desc"),
-		UA:          userAddress,
-		Time:        time.Now(),
-		Likes:       0,
-		IH:          imageHash,
-		Id:          StringRandom(10),
-		Type:        _type,
-		Mapping:     make(map[string]int),
+	if len(media) == 0 && fields["desc"] == "" {
+		app.errorJSON(w, apiError(CodeInvalidRequest, nil, "request must contain either media or text"))
+		return
 	}
-	log.Println("check 22")
 
-	metadataBytes, err := json.Marshal(metadata)
+	post, err := app.createPost(r.Context(), userAddress, mediaType, fields["desc"], fields["campaign"], media...)
 	if err != nil {
-		app.errorJSON(w, errors.New("error encoding metadata"))
+		app.errorJSON(w, err)
 		return
 	}
 
-	cid, err := ReadCIDFromFile()
-	if err != nil {
-		app.errorJSON(w, errors.New(err.Error()))
-		return
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "post created",
+		Data: map[string]interface{}{
+			"id":             post.Id,
+			"published_head": post.Head,
+			"post":           app.postV1(post.Post, userAddress),
+		},
+	})
+}
+
+// checkUploadFields validates the fields of a multipart upload that have to
+// be known before its first file is stored.
+func checkUploadFields(fields map[string]string) error {
+	for _, name := range []string{"user_address", "media_type"} {
+		if _, ok := fields[name]; !ok {
+			return apiErrorf(CodeInvalidRequest, "%s must come before the files", name)
+		}
 	}
-	log.Println("check 6666")
 
-	existingJSON, err := fetchFromIPFS(cid)
-	if err != nil {
-		fmt.Println("Error fetching existing JSON data from IPFS:", err)
-		app.errorJSON(w, errors.New(err.Error()))
-		return
+	var v ValidationError
+	v.address("user_address", fields["user_address"])
+	v.required("media_type", fields["media_type"])
+	if err := v.err(); err != nil {
+		return err
 	}
 
-	log.Println("check 0000000009")
+	if len(allowedMIME[fields["media_type"]]) == 0 {
+		return checkMIME(fields["media_type"], "")
+	}
+
+	return nil
+}
 
-	updatedJSON := appendJSON(existingJSON, string(metadataBytes))
+// createdPost is the new post and the feed head at the time it was
+// created, returned as published_head. The post reaches IPFS with the next
+// snapshot, so that head does not contain it yet: the feed is eventually
+// consistent, and clients read their post back through the API.
+type createdPost struct {
+	Post
+	Head string
+}
 
-	hash, err := uploadToIPFS(updatedJSON)
+// createPost adds a post with the already stored media to the database
+// and queues the media for the storage service.
+func (app *Config) createPost(ctx context.Context, userAddress, mediaType, desc, campaignID string, media ...*storedMedia) (*createdPost, error) {
+	campaign, err := getCampaign(campaignID)
 	if err != nil {
-		fmt.Println("Error uploading updated JSON to IPFS:", err)
-		app.errorJSON(w, errors.New(err.Error()))
-		return
+		return nil, err
 	}
-	fmt.Println("Uploaded updated JSON to IPFS with hash:", hash)
 
-	WriteCIDToFile(hash)
+	var _type int
 
-	token, err := getBearerToken()
-	if err != nil {
-		app.errorJSON(w, errors.New("failed to get bearer token"))
-		return
+	switch mediaType {
+	case mediaTypeText:
+		_type = 1
+	case mediaTypeImage:
+		_type = 2
+	case mediaTypeVideo:
+		_type = 3
+	default:
+		var v ValidationError
+		v.add("media_type", CodeInvalidRequest, "must be 1, 2 or 3")
+		return nil, v.err()
 	}
 
-	if file != nil {
-		_, err = file.Seek(0, io.SeekStart) // Reset the file pointer to the beginning
-		if err != nil {
-			app.errorJSON(w, errors.New("error resetting file pointer"))
-			return
-		}
-		err = uploadData(token, userAddress, file, fileHeader.Filename)
+	for _, m := range media {
+		err = checkMIME(mediaType, m.MimeType)
 		if err != nil {
-			app.errorJSON(w, errors.New("failed to upload data"))
-			return
+			return nil, err
 		}
 	}
 
-	app.writeJSON(w, http.StatusOK, map[string]interface{}{
-		"status":        true,
-		"metadata_hash": hash,
-	})
-}
-
-func getBearerToken() (string, error) {
-	url := "http://10.0.0.15:3001/v1/login"
-	payload := strings.NewReader("{ \"userName\":\"diamRoot\", \"mpin\":\"95c21b00cad15f9b1357dafc3bbd8495\" }")
+	metadata := Post{
+		Name:        "",
+		Description: desc,
+		UserAddress: userAddress,
+		Time:        time.Now(),
+		LikeCount:   0,
+		Type:        _type,
+		Likers:      make(map[string]int),
+		Campaign:    campaign.ID,
+	}
 
-	req, err := http.NewRequest("POST", url, payload)
-	if err != nil {
-		return "", err
+	for _, m := range media {
+		metadata.Attachments = append(metadata.Attachments, newAttachment(m))
+	}
+	if len(metadata.Attachments) > 0 {
+		metadata.ImageHash = metadata.Attachments[0].CID
 	}
 
-	req.Header.Add("Accept", "*/*")
-	req.Header.Add("User-Agent", "Thunder Client (https://www.thunderclient.com)")
-	req.Header.Add("Content-Type", "application/json")
+	// A clash is all but impossible, but the database would refuse it.
+	for attempt := 0; attempt < 3; attempt++ {
+		metadata.Id, err = newPostID(metadata.Time)
+		if err != nil {
+			return nil, err
+		}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+		err = app.DB.InsertPost(metadata)
+		if !errors.Is(err, errDuplicatePost) {
+			break
+		}
 	}
-	defer res.Body.Close()
-
-	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var response map[string]interface{}
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return "", err
-	}
+	hash, _ := ReadCIDFromFile()
+	app.pinMedia(metadata.Id, metadata.Attachments)
 
-	token, ok := response["token"].(string)
-	if !ok {
-		return "", errors.New("invalid token response")
+	// The post is live; a failed mirror must not fail the request.
+	for _, m := range media {
+		err = app.enqueueMirror(metadata.Id, userAddress, m)
+		if err != nil {
+			log.Printf("post %s: could not queue %s for mirroring: %v", metadata.Id, m.CID, err)
+		}
 	}
 
-	return token, nil
+	return &createdPost{Post: metadata, Head: hash}, nil
 }
+
 func (app *Config) getMetaData(w http.ResponseWriter, r *http.Request) {
 
 	var payload RequestPayload
@@ -309,45 +296,28 @@ func (app *Config) getMetaData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer r.Body.Close()
-
-	cid, err := app.getCidFromFile()
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
-	}
-
-	url := fmt.Sprintf("https://browseipfs.diamcircle.io/ipfs/%s", cid)
-	fmt.Printf("URL: %s\n", url)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+	var v ValidationError
+	v.address("user_address", payload.UserAddress)
+	v.optionalAddress("viewer_address", payload.ViewerAddress)
+	if err := v.err(); err != nil {
+		app.errorJSON(w, err)
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
-	}
+	defer r.Body.Close()
 
-	var data []MetadataResponse
-	err = json.Unmarshal([]byte(body), &data)
+	data, err := app.DB.PostsByUser(payload.UserAddress)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	filteredData := make([]MetadataResponse, 0)
-	for _, item := range data {
-		if item.UserAddress == payload.UserAddress {
-			filteredData = append(filteredData, item)
-		}
-	}
+	filteredData := app.postsV1(data, payload.ViewerAddress)
 
-	app.writeJSON(w, http.StatusOK, filteredData)
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: fmt.Sprintf("%d posts", len(filteredData)),
+		Data:    filteredData,
+	})
 }
 
 func ReadCIDFromFile() (string, error) {
@@ -372,70 +342,6 @@ func ReadCIDFromFile() (string, error) {
 	return cidData.CID, nil
 }
 
-func fetchFromIPFS(cid string) (string, error) {
-	// Send HTTP GET request to IPFS API
-	resp, err := http.Get("https://browseipfs.diamcircle.io/ipfs/" + cid)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// Read response body
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	// Convert response body to string
-	return string(data), nil
-}
-
-func appendJSON(existingJSON, newJSON string) string {
-	// Unmarshal existing JSON array
-	var existingArray []IPFSData
-
-	if err := json.Unmarshal([]byte(existingJSON), &existingArray); err != nil {
-		fmt.Println("Error unmarshaling existing JSON:", err)
-		return existingJSON
-	}
-
-	// Unmarshal new JSON object
-	var newObj IPFSData
-	if err := json.Unmarshal([]byte(newJSON), &newObj); err != nil {
-		fmt.Println("Error unmarshaling new JSON:", err)
-		return existingJSON
-	}
-
-	// Append new JSON object to existing array
-	existingArray = append(existingArray, newObj)
-
-	// Marshal the updated array back to JSON
-	updatedJSON, err := json.Marshal(existingArray)
-	if err != nil {
-		fmt.Println("Error marshaling updated JSON:", err)
-		return existingJSON
-	}
-
-	return string(updatedJSON)
-}
-
-func uploadToIPFS(data string) (string, error) {
-
-	sh := shell.NewShell("https://uploadipfs.diamcircle.io")
-
-	reader := bytes.NewReader([]byte(data))
-
-	cid, err := sh.Add(reader)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %s", err)
-		return "", err
-	}
-
-	log.Println(cid)
-
-	return cid, nil
-}
-
 func WriteCIDToFile(cid string) error {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -463,21 +369,16 @@ func WriteCIDToFile(cid string) error {
 }
 
 func (app *Config) getCIDFromFile(w http.ResponseWriter, r *http.Request) {
-	data, err := ioutil.ReadFile("mainCID.json")
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	var mainCID MainCID
-	err = json.Unmarshal(data, &mainCID)
+	cid, err := app.getCidFromFile()
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		app.errorJSON(w, apiError(CodeHeadUnavailable, err))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(mainCID)
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "current head",
+		Data:    MainCID{CID: cid},
+	})
 }
 
 func (app *Config) getCidFromFile() (string, error) {
@@ -509,130 +410,55 @@ func (app *Config) addLikesToPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cid, err := ReadCIDFromFile()
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
+	var v ValidationError
+	v.address("public_key", payload.PublicKey)
+	v.required("id", payload.Id)
+	if payload.Count != 1 && payload.Count != -1 {
+		v.add("count", CodeInvalidRequest, "must be 1 to like or -1 to unlike")
 	}
-
-	url := fmt.Sprintf("https://browseipfs.diamcircle.io/ipfs/%s", cid)
-	resp, err := http.Get(url)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+	if err := v.err(); err != nil {
+		app.errorJSON(w, err)
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	item, err := app.DB.Post(payload.Id)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+		app.errorJSON(w, err)
 		return
 	}
 
-	var data []IPFSData
-	err = json.Unmarshal([]byte(body), &data)
+	campaign, err := getCampaign(item.Campaign)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+		app.errorJSON(w, err)
 		return
 	}
 
-	for i, item := range data {
-		if item.Id == payload.Id {
-			if _, ok := item.Mapping[payload.PublicKey]; ok {
-				app.writeJSON(w, http.StatusOK, "user has already liked the post!")
-				return
-			}
-
-			temp := item.Likes
-			data[i].Likes = temp + payload.Count
-
-			if data[i].Likes == 99 {
-				source := "SBNBAF32CLQYKVUSGLUKSHSGNKMZPYBKYEWXDL6CAAHMQWD5I3DC2ZV4"
-				client := auroraclient.DefaultTestNetClient
-
-				sourceKP := keypair.MustParseFull(source)
-
-				sourceAccountRequest := auroraclient.AccountRequest{AccountID: sourceKP.Address()}
-
-				sourceAccount, err := client.AccountDetail(sourceAccountRequest)
-				if err != nil {
-					app.errorJSON(w, err, http.StatusInternalServerError)
-					return
-				}
-
-				var Operations []txnbuild.Operation
-
-				for i := 0; i < len(data); i++ {
-					Operations = append(Operations, &txnbuild.Payment{
-						Destination: item.UA,
-						Amount:      "50",
-						Asset:       txnbuild.NativeAsset{},
-					})
-				}
-
-				tx, err := txnbuild.NewTransaction(
-					txnbuild.TransactionParams{
-						SourceAccount:        &sourceAccount,
-						IncrementSequenceNum: true,
-						BaseFee:              txnbuild.MinBaseFee,
-						Timebounds:           txnbuild.NewInfiniteTimeout(),
-						Operations:           Operations,
-					},
-				)
-
-				if err != nil {
-					app.errorJSON(w, err, http.StatusInternalServerError)
-					return
-				}
-
-				tx, err = tx.Sign(network.TestNetworkPassphrase, sourceKP)
-				if err != nil {
-					app.errorJSON(w, err, http.StatusInternalServerError)
-					return
-				}
-
-				_, err = auroraclient.DefaultTestNetClient.SubmitTransaction(tx)
-				if err != nil {
-					app.errorJSON(w, err, http.StatusInternalServerError)
-					return
-				}
-			}
-
-			if payload.Count > 0 {
-				data[i].Mapping[payload.PublicKey] = 1
-			} else if payload.Count < 0 {
-				delete(data[i].Mapping, payload.PublicKey)
-			}
-
-			break
-		}
-	}
-
-	marshalled, err := json.Marshal(data)
+	queued, err := app.DB.LikePost(payload.Id, payload.PublicKey, payload.Count, campaign.LikeThreshold)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+		app.errorJSON(w, err)
 		return
 	}
-
-	_cid, err := uploadToIPFS(string(marshalled))
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
+	if queued {
+		wakeRewards()
 	}
 
-	err = WriteCIDToFile(_cid)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
-	}
+	// The like reaches IPFS with the next snapshot; see createdPost.
+	_cid, _ := ReadCIDFromFile()
 
-	app.writeJSON(w, http.StatusOK, "like added !")
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "like added",
+		Data: map[string]interface{}{
+			"id":             payload.Id,
+			"published_head": _cid,
+		},
+	})
 }
 
 func (app *Config) getPostFromId(w http.ResponseWriter, r *http.Request) {
 	type getPost struct {
-		PublicKey  string `json:"user_address"`
-		Image_hash string `json:"image_hash"`
+		PublicKey     string `json:"user_address"`
+		Image_hash    string `json:"image_hash"`
+		ViewerAddress string `json:"viewer_address"`
 	}
 	var payload getPost
 
@@ -642,50 +468,43 @@ func (app *Config) getPostFromId(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer r.Body.Close()
-
-	cid, err := app.getCidFromFile()
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+	var v ValidationError
+	v.address("user_address", payload.PublicKey)
+	v.required("image_hash", payload.Image_hash)
+	v.optionalAddress("viewer_address", payload.ViewerAddress)
+	if err := v.err(); err != nil {
+		app.errorJSON(w, err)
 		return
 	}
 
-	url := fmt.Sprintf("https://browseipfs.diamcircle.io/ipfs/%s", cid)
-	fmt.Printf("URL: %s\n", url)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
+	defer r.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	data, err := app.DB.PostsByUser(payload.PublicKey)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	var data []MetadataResponse
-	err = json.Unmarshal([]byte(body), &data)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
-	}
+	// Clients may send the CID or any gateway URL of it.
+	imageHash := bareCID(payload.Image_hash)
 
-	filteredData := make([]MetadataResponse, 0)
+	filteredData := make([]PostV1, 0)
 	for _, item := range data {
-		if (item.UserAddress == payload.PublicKey) && (item.ImageHash == payload.Image_hash) {
-			filteredData = append(filteredData, item)
+		if item.ImageHash == imageHash {
+			filteredData = append(filteredData, app.postV1(item, payload.ViewerAddress))
 		}
 	}
 
-	app.writeJSON(w, http.StatusOK, filteredData)
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: fmt.Sprintf("%d posts", len(filteredData)),
+		Data:    filteredData,
+	})
 }
 
 func (app *Config) getPostFromAddress(w http.ResponseWriter, r *http.Request) {
 	type getPost struct {
-		PublicKey string `json:"user_address"`
+		PublicKey     string `json:"user_address"`
+		ViewerAddress string `json:"viewer_address"`
 	}
 	var payload getPost
 
@@ -695,43 +514,26 @@ func (app *Config) getPostFromAddress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer r.Body.Close()
-
-	cid, err := app.getCidFromFile()
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
-	}
-
-	url := fmt.Sprintf("https://browseipfs.diamcircle.io/ipfs/%s", cid)
-	fmt.Printf("URL: %s\n", url)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+	var v ValidationError
+	v.address("user_address", payload.PublicKey)
+	v.optionalAddress("viewer_address", payload.ViewerAddress)
+	if err := v.err(); err != nil {
+		app.errorJSON(w, err)
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
-		return
-	}
+	defer r.Body.Close()
 
-	var data []MetadataResponse
-	err = json.Unmarshal([]byte(body), &data)
+	data, err := app.DB.PostsByUser(payload.PublicKey)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	filteredData := make([]MetadataResponse, 0)
-	for _, item := range data {
-		if item.UserAddress == payload.PublicKey {
-			filteredData = append(filteredData, item)
-		}
-	}
+	filteredData := app.postsV1(data, payload.ViewerAddress)
 
-	app.writeJSON(w, http.StatusOK, filteredData)
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: fmt.Sprintf("%d posts", len(filteredData)),
+		Data:    filteredData,
+	})
 }
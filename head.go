@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// The head CID lives in mainCID.json and is served by /getCid. Publishers
+// announce it elsewhere as well, under an IPNS name or as a DNSLink record,
+// so others can find the latest feed without asking this server. A worker
+// publishes the current head after every change and keeps retrying the
+// publishers that failed.
+
+const (
+	headPublishIPNS    = "ipns"
+	headPublishDNSLink = "dnslink"
+
+	headPublishRetry   = time.Minute
+	headPublishTimeout = 2 * time.Minute
+)
+
+var (
+	publishMutex sync.Mutex
+	publishWake  = make(chan struct{}, 1)
+
+	// publications is what each publisher last did, by publisher name.
+	publications = make(map[string]*Publication)
+)
+
+// errNoIPNSRecord means nothing was ever published under the IPNS key.
+var errNoIPNSRecord = errors.New("no IPNS record")
+
+// HeadPublisher announces the head CID somewhere outside this server.
+type HeadPublisher interface {
+	Name() string
+	// Publish announces cid and returns where it can be resolved.
+	Publish(ctx context.Context, cid string) (string, error)
+}
+
+type Publication struct {
+	Publisher   string    `json:"publisher"`
+	CID         string    `json:"cid,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	PublishedAt time.Time `json:"published_at,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// headChanged is called whenever cid becomes the head: it keeps the root
+// pinned and has it published.
+func (app *Config) headChanged(cid string) {
+	app.pinRoot(cid)
+
+	if len(app.Publishers) > 0 {
+		select {
+		case publishWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runPublisher publishes the current head until ctx is cancelled.
+func (app *Config) runPublisher(ctx context.Context) {
+	if len(app.Publishers) == 0 {
+		return
+	}
+
+	tick := time.NewTicker(headPublishRetry)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-publishWake:
+		case <-tick.C:
+		}
+
+		cid, err := ReadCIDFromFile()
+		if err != nil {
+			log.Println("publishing head:", err)
+			continue
+		}
+
+		for _, p := range app.Publishers {
+			app.publishHead(ctx, p, cid)
+		}
+	}
+}
+
+// publishHead publishes cid with p unless that has already been done.
+func (app *Config) publishHead(ctx context.Context, p HeadPublisher, cid string) {
+	publishMutex.Lock()
+	last := publications[p.Name()]
+	publishMutex.Unlock()
+	if last != nil && last.CID == cid && last.LastError == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, headPublishTimeout)
+	defer cancel()
+
+	target, err := p.Publish(ctx, cid)
+
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+
+	pub := publications[p.Name()]
+	if pub == nil {
+		pub = &Publication{Publisher: p.Name()}
+		publications[p.Name()] = pub
+	}
+	if err != nil {
+		log.Printf("publishing head %s with %s: %v", cid, p.Name(), err)
+		pub.LastError = err.Error()
+		return
+	}
+
+	log.Printf("published head %s at %s", cid, target)
+	pub.CID = cid
+	pub.Target = target
+	pub.PublishedAt = time.Now()
+	pub.LastError = ""
+}
+
+func (app *Config) headStatus(w http.ResponseWriter, r *http.Request) {
+	cid, err := ReadCIDFromFile()
+	if err != nil {
+		app.errorJSON(w, apiError(CodeHeadUnavailable, err))
+		return
+	}
+
+	publishMutex.Lock()
+	pubs := make([]Publication, 0, len(app.Publishers))
+	for _, p := range app.Publishers {
+		if pub := publications[p.Name()]; pub != nil {
+			pubs = append(pubs, *pub)
+		} else {
+			pubs = append(pubs, Publication{Publisher: p.Name()})
+		}
+	}
+	publishMutex.Unlock()
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "current head",
+		Data: map[string]interface{}{
+			"cid":          cid,
+			"publications": pubs,
+		},
+	})
+}
+
+// configurePublishers sets up the publishers named in HEAD_PUBLISH.
+func (app *Config) configurePublishers() error {
+	for _, name := range strings.Split(envOr("HEAD_PUBLISH", ""), ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case headPublishIPNS:
+			app.Publishers = append(app.Publishers, &IPNSPublisher{
+				Node:     app.IPFSNode,
+				Key:      envOr("IPNS_KEY", "self"),
+				Lifetime: envDuration("IPNS_LIFETIME", 48*time.Hour),
+				TTL:      envDuration("IPNS_TTL", time.Minute),
+			})
+		case headPublishDNSLink:
+			p := &DNSLinkPublisher{
+				Domain: strings.TrimSuffix(envOr("DNSLINK_DOMAIN", ""), "."),
+				File:   envOr("DNSLINK_FILE", "dnslink.txt"),
+				TTL:    envDuration("DNSLINK_TTL", time.Minute),
+			}
+			if p.Domain == "" {
+				return errors.New("dnslink publishing needs DNSLINK_DOMAIN")
+			}
+			app.Publishers = append(app.Publishers, p)
+		default:
+			return fmt.Errorf("unknown head publisher %q", name)
+		}
+	}
+
+	return nil
+}
+
+// IPNSPublisher publishes the head under an IPNS key of the local node.
+type IPNSPublisher struct {
+	Node     string
+	Key      string
+	Lifetime time.Duration
+	TTL      time.Duration
+}
+
+func (p *IPNSPublisher) Name() string { return headPublishIPNS }
+
+func (p *IPNSPublisher) Publish(ctx context.Context, cid string) (string, error) {
+	var out shell.PublishResponse
+	err := shell.NewShell(p.Node).Request("name/publish", "/ipfs/"+cid).
+		Option("key", p.Key).
+		Option("lifetime", p.Lifetime.String()).
+		Option("ttl", p.TTL.String()).
+		Option("allow-offline", true).
+		Exec(ctx, &out)
+	if err != nil {
+		return "", err
+	}
+
+	return "/ipns/" + out.Name, nil
+}
+
+// Resolve returns the CID currently published under the key.
+func (p *IPNSPublisher) Resolve(ctx context.Context) (string, error) {
+	sh := shell.NewShell(p.Node)
+
+	var keys struct{ Keys []shell.Key }
+	err := sh.Request("key/list").Exec(ctx, &keys)
+	if err != nil {
+		return "", err
+	}
+
+	id := ""
+	for _, k := range keys.Keys {
+		if k.Name == p.Key {
+			id = k.Id
+		}
+	}
+	if id == "" {
+		return "", fmt.Errorf("no IPNS key %q on the node", p.Key)
+	}
+
+	var out struct{ Path string }
+	err = sh.Request("name/resolve", "/ipns/"+id).Exec(ctx, &out)
+	if err != nil {
+		// Kubo has no error code for this, only the message.
+		if msg := err.Error(); strings.Contains(msg, "not found") || strings.Contains(msg, "could not resolve name") {
+			return "", fmt.Errorf("%w: %v", errNoIPNSRecord, err)
+		}
+		return "", err
+	}
+
+	cid, ok := strings.CutPrefix(out.Path, "/ipfs/")
+	if !ok {
+		return "", fmt.Errorf("IPNS name resolved to %q", out.Path)
+	}
+
+	return cid, nil
+}
+
+// DNSLinkPublisher writes the DNSLink TXT record for the head to a file in
+// zone file syntax, for whatever keeps the DNS zone up to date to pick up.
+type DNSLinkPublisher struct {
+	Domain string
+	File   string
+	TTL    time.Duration
+}
+
+func (p *DNSLinkPublisher) Name() string { return headPublishDNSLink }
+
+func (p *DNSLinkPublisher) Publish(ctx context.Context, cid string) (string, error) {
+	record := fmt.Sprintf("_dnslink.%s. %d IN TXT %s\n",
+		p.Domain, int(p.TTL.Seconds()), strconv.Quote("dnslink=/ipfs/"+cid))
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.File), ".dnslink-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(record)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmp.Name(), p.File)
+	if err != nil {
+		return "", err
+	}
+
+	return "/ipns/" + p.Domain, nil
+}
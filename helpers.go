@@ -1,16 +1,50 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"io"
+	"log"
 	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
 )
 
+const requestIDHeader = "X-Request-Id"
+
+// jsonResponse is the envelope every endpoint answers with, for successes
+// and errors alike.
 type jsonResponse struct {
-	Error   bool   `json:"error"`
-	Message string `json:"message"`
-	Data    any    `json:"data,omitempty"`
+	Error     bool         `json:"error"`
+	Code      ErrorCode    `json:"code,omitempty"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"request_id,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	Data      any          `json:"data,omitempty"`
+}
+
+// requestID echoes the id assigned by middleware.RequestID in the response
+// headers, where writeJSON picks it up for the envelope.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin guards the admin endpoints with the ADMIN_TOKEN bearer token.
+// They are closed entirely when no token is configured.
+func (app *Config) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := []byte("Bearer " + app.AdminToken)
+		given := []byte(r.Header.Get("Authorization"))
+		if app.AdminToken == "" || subtle.ConstantTimeCompare(token, given) != 1 {
+			app.errorJSON(w, errUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (app *Config) readJSON(w http.ResponseWriter, r *http.Request, data any) error {
@@ -34,6 +68,11 @@ func (app *Config) readJSON(w http.ResponseWriter, r *http.Request, data any) er
 }
 
 func (app *Config) writeJSON(w http.ResponseWriter, status int, data any, headers ...http.Header) error {
+	if resp, ok := data.(jsonResponse); ok && resp.RequestID == "" {
+		resp.RequestID = w.Header().Get(requestIDHeader)
+		data = resp
+	}
+
 	out, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -45,6 +84,8 @@ func (app *Config) writeJSON(w http.ResponseWriter, status int, data any, header
 		}
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+
 	w.WriteHeader(status)
 	_, err = w.Write(out)
 	if err != nil {
@@ -55,7 +96,7 @@ func (app *Config) writeJSON(w http.ResponseWriter, status int, data any, header
 }
 
 func (app *Config) errorJSON(w http.ResponseWriter, err error, status ...int) error {
-	statusCode := http.StatusBadRequest
+	statusCode := http.StatusInternalServerError
 
 	if len(status) > 0 {
 		statusCode = status[0]
@@ -64,7 +105,18 @@ func (app *Config) errorJSON(w http.ResponseWriter, err error, status ...int) er
 	var payload jsonResponse
 
 	payload.Error = true
+	payload.Code, statusCode = errorCode(err, statusCode)
 	payload.Message = err.Error()
 
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		payload.Message = "invalid request"
+		payload.Fields = ve.Fields
+	}
+
+	if statusCode >= http.StatusInternalServerError {
+		log.Printf("request %s: %v", w.Header().Get(requestIDHeader), err)
+	}
+
 	return app.writeJSON(w, statusCode, payload)
 }
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// Image uploads are published as several variants. Every variant is
+// re-encoded or has its metadata segments removed, so no EXIF (GPS,
+// camera serials) ever reaches IPFS.
+
+const (
+	variantThumbnail = "thumbnail"
+	variantMedium    = "medium"
+	variantOriginal  = "original"
+
+	// maxImagePixels guards the decoder against decompression bombs.
+	maxImagePixels = 50_000_000
+)
+
+var imageVariants = []struct {
+	Name    string
+	MaxSide int
+}{
+	{variantThumbnail, 320},
+	{variantMedium, 1080},
+}
+
+// processedImage holds the encoded bytes of each variant, keyed by variant
+// name. Variants the image is already smaller than are left out and served
+// from the original.
+type processedImage map[string][]byte
+
+func canProcessImage(mime string) bool {
+	switch mime {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+
+	return false
+}
+
+// processImage strips metadata from data and renders the resized variants.
+// WebP has no decoder in the standard library, so it only gets its metadata
+// chunks removed.
+func processImage(data []byte, mime string) (processedImage, error) {
+	out := make(processedImage)
+
+	switch mime {
+	case "image/webp":
+		stripped, err := stripWebP(data)
+		if err != nil {
+			return nil, err
+		}
+		out[variantOriginal] = stripped
+		return out, nil
+	case "image/gif":
+		// GIFs carry no EXIF and re-encoding would drop the animation.
+		out[variantOriginal] = data
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, apiErrorf(CodePayloadTooLarge, "image is %dx%d, at most %d pixels are allowed", cfg.Width, cfg.Height, maxImagePixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if mime == "image/jpeg" {
+		// The orientation lives in the EXIF we are about to drop, so
+		// apply it to the pixels instead.
+		orientation := jpegOrientation(data)
+		if orientation > 1 {
+			img = orient(img, orientation)
+			out[variantOriginal], err = encodeImage(img, mime)
+		} else {
+			out[variantOriginal], err = stripJPEG(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if mime == "image/png" {
+		out[variantOriginal], err = stripPNG(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range imageVariants {
+		b := img.Bounds()
+		if b.Dx() <= v.MaxSide && b.Dy() <= v.MaxSide {
+			continue
+		}
+
+		out[v.Name], err = encodeImage(resize(img, v.MaxSide), mime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// imageSize returns the pixel dimensions of an encoded image, or zeros when
+// they cannot be read.
+func imageSize(data []byte, mime string) (int, int) {
+	if mime == "image/webp" {
+		return webpSize(data)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0
+	}
+
+	return cfg.Width, cfg.Height
+}
+
+// webpSize reads the canvas size from the first chunk of a WebP file.
+func webpSize(data []byte) (int, int) {
+	if len(data) < 30 {
+		return 0, 0
+	}
+
+	c := data[20:]
+	switch string(data[12:16]) {
+	case "VP8X":
+		w := int(c[4]) | int(c[5])<<8 | int(c[6])<<16
+		h := int(c[7]) | int(c[8])<<8 | int(c[9])<<16
+		return w + 1, h + 1
+	case "VP8 ":
+		w := int(binary.LittleEndian.Uint16(c[6:])) & 0x3FFF
+		h := int(binary.LittleEndian.Uint16(c[8:])) & 0x3FFF
+		return w, h
+	case "VP8L":
+		bits := binary.LittleEndian.Uint32(c[1:])
+		return int(bits&0x3FFF) + 1, int(bits>>14&0x3FFF) + 1
+	}
+
+	return 0, 0
+}
+
+// encodeImage writes JPEG for JPEG sources and PNG otherwise, so
+// transparency survives.
+func encodeImage(img image.Image, mime string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+
+	if mime == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+
+	return buf.Bytes(), err
+}
+
+// resize scales img down so its longest side is maxSide, averaging every
+// source pixel that falls into a destination pixel.
+func resize(img image.Image, maxSide int) *image.RGBA {
+	sb := img.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+
+	dw, dh := maxSide, maxSide
+	if sw >= sh {
+		dh = max(1, sh*maxSide/sw)
+	} else {
+		dw = max(1, sw*maxSide/sh)
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, sb.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[i])
+					g += uint64(src.Pix[i+1])
+					b += uint64(src.Pix[i+2])
+					a += uint64(src.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// orient applies an EXIF orientation (2-8) to img.
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+
+	return dst
+}
+
+var errBadImage = errors.New("malformed image file")
+
+// jpegSegments calls fn for every marker segment before the image data.
+// fn returns false to stop early.
+func jpegSegments(data []byte, fn func(marker byte, segment []byte) bool) (sos int, err error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, errBadImage
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 0, errBadImage
+		}
+
+		marker := data[i+1]
+		if marker == 0xDA {
+			return i, nil
+		}
+
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return 0, errBadImage
+		}
+
+		if !fn(marker, data[i:i+2+n]) {
+			return i, nil
+		}
+		i += 2 + n
+	}
+
+	return 0, errBadImage
+}
+
+// stripJPEG drops EXIF/XMP (APP1), IPTC (APP13), comments and vendor APP
+// segments. JFIF (APP0), ICC profiles (APP2) and Adobe (APP14) are kept
+// because decoders need them to get the colours right.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := []byte{0xFF, 0xD8}
+
+	sos, err := jpegSegments(data, func(marker byte, segment []byte) bool {
+		keep := true
+		switch {
+		case marker == 0xFE:
+			keep = false
+		case marker == 0xE2:
+			keep = bytes.HasPrefix(segment[4:], []byte("ICC_PROFILE\x00"))
+		case marker >= 0xE1 && marker <= 0xEF:
+			keep = marker == 0xEE
+		}
+		if keep {
+			out = append(out, segment...)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, data[sos:]...), nil
+}
+
+// jpegOrientation reads the EXIF orientation tag, or 1 when there is none.
+func jpegOrientation(data []byte) int {
+	orientation := 1
+
+	jpegSegments(data, func(marker byte, segment []byte) bool {
+		if marker != 0xE1 || !bytes.HasPrefix(segment[4:], []byte("Exif\x00\x00")) {
+			return true
+		}
+
+		tiff := segment[10:]
+		if len(tiff) < 8 {
+			return false
+		}
+
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return false
+		}
+
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd+2 > len(tiff) {
+			return false
+		}
+
+		entries := int(order.Uint16(tiff[ifd:]))
+		for e := 0; e < entries; e++ {
+			off := ifd + 2 + e*12
+			if off+12 > len(tiff) {
+				break
+			}
+			if order.Uint16(tiff[off:]) == 0x0112 {
+				if v := int(order.Uint16(tiff[off+8:])); v >= 1 && v <= 8 {
+					orientation = v
+				}
+				break
+			}
+		}
+		return false
+	})
+
+	return orientation
+}
+
+// stripPNG drops the text, EXIF and timestamp chunks.
+func stripPNG(data []byte) ([]byte, error) {
+	const sig = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(sig)) {
+		return nil, errBadImage
+	}
+
+	out := []byte(sig)
+	for i := len(sig); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errBadImage
+		}
+
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return nil, errBadImage
+		}
+
+		switch string(data[i+4 : i+8]) {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+
+	return out, nil
+}
+
+// stripWebP drops the EXIF and XMP chunks of a WebP file and clears their
+// flags in the VP8X header.
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errBadImage
+	}
+
+	out := append([]byte{}, data[:12]...)
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errBadImage
+		}
+
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + n + n%2
+		if end > len(data) {
+			return nil, errBadImage
+		}
+
+		switch fourcc := string(data[i : i+4]); fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, data[i:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
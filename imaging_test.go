@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func jpegSegment(marker byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := binary.BigEndian.AppendUint16([]byte{0xFF, marker}, uint16(2+len(body)))
+	return append(b, body...)
+}
+
+// exifSegment is an APP1 EXIF segment whose first IFD holds only the
+// orientation tag.
+func exifSegment(order binary.AppendByteOrder, orientation int) []byte {
+	tiff := []byte("II")
+	if order == binary.BigEndian {
+		tiff = []byte("MM")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8)
+
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3) // SHORT
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0)
+	tiff = order.AppendUint32(tiff, 0)
+
+	return jpegSegment(0xE1, []byte("Exif\x00\x00"), tiff)
+}
+
+var (
+	jfifSegment = jpegSegment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	iccSegment  = jpegSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01"), []byte("profile"))
+	xmpSegment  = jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00"), []byte("<x:xmpmeta/>"))
+	iptcSegment = jpegSegment(0xED, []byte("Photoshop 3.0\x00"), []byte("8BIM"))
+	comSegment  = jpegSegment(0xFE, []byte("taken at home"))
+)
+
+// jpegFixture encodes img and puts segments right after SOI.
+func jpegFixture(t testing.TB, img image.Image, segments ...[]byte) []byte {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, buf.Bytes()[2:]...)
+}
+
+func solidImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	return img
+}
+
+func TestStripJPEG(t *testing.T) {
+	data := jpegFixture(t, solidImage(16, 16),
+		jfifSegment, exifSegment(binary.LittleEndian, 6), xmpSegment, iccSegment, iptcSegment, comSegment)
+
+	out, err := stripJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kept [][]byte
+	_, err = jpegSegments(out, func(marker byte, segment []byte) bool {
+		if marker >= 0xE0 && marker <= 0xEF || marker == 0xFE {
+			kept = append(kept, segment)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kept) != 2 || !bytes.Equal(kept[0], jfifSegment) || !bytes.Equal(kept[1], iccSegment) {
+		t.Errorf("kept %q, want the JFIF and ICC segments", kept)
+	}
+	for _, leak := range []string{"Exif", "xap/1.0", "Photoshop", "taken at home"} {
+		if bytes.Contains(out, []byte(leak)) {
+			t.Errorf("%q survived", leak)
+		}
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped file does not decode: %v", err)
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := solidImage(8, 8)
+
+	for _, order := range []binary.AppendByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for want := 1; want <= 8; want++ {
+			data := jpegFixture(t, img, jfifSegment, exifSegment(order, want))
+			if got := jpegOrientation(data); got != want {
+				t.Errorf("%v orientation %d: got %d", order, want, got)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no exif", jpegFixture(t, img, jfifSegment)},
+		{"xmp only", jpegFixture(t, img, xmpSegment)},
+		{"out of range", jpegFixture(t, img, exifSegment(binary.BigEndian, 9))},
+		{"truncated exif", jpegFixture(t, img, jpegSegment(0xE1, []byte("Exif\x00\x00MM\x00\x2A")))},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != 1 {
+				t.Errorf("got %d, want 1", got)
+			}
+		})
+	}
+}
+
+// quadrants paints a w×h image in four colours, listed top left, top
+// right, bottom left, bottom right.
+func quadrants(w, h int, c [4]color.RGBA) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := 0
+			if x >= w/2 {
+				i++
+			}
+			if y >= h/2 {
+				i += 2
+			}
+			img.SetRGBA(x, y, c[i])
+		}
+	}
+	return img
+}
+
+func TestProcessImageOrientation(t *testing.T) {
+	r := color.RGBA{255, 0, 0, 255}
+	g := color.RGBA{0, 255, 0, 255}
+	b := color.RGBA{0, 0, 255, 255}
+	w := color.RGBA{255, 255, 255, 255}
+
+	// How a camera stores an image that is shown 64x32 with red, green,
+	// blue and white quadrants, for every EXIF orientation.
+	tests := []struct {
+		orientation int
+		stored      image.Image
+	}{
+		{1, quadrants(64, 32, [4]color.RGBA{r, g, b, w})},
+		{2, quadrants(64, 32, [4]color.RGBA{g, r, w, b})},
+		{3, quadrants(64, 32, [4]color.RGBA{w, b, g, r})},
+		{4, quadrants(64, 32, [4]color.RGBA{b, w, r, g})},
+		{5, quadrants(32, 64, [4]color.RGBA{r, b, g, w})},
+		{6, quadrants(32, 64, [4]color.RGBA{g, w, r, b})},
+		{7, quadrants(32, 64, [4]color.RGBA{w, g, b, r})},
+		{8, quadrants(32, 64, [4]color.RGBA{b, r, w, g})},
+	}
+
+	for _, tt := range tests {
+		data := jpegFixture(t, tt.stored, jfifSegment, exifSegment(binary.BigEndian, tt.orientation))
+
+		out, err := processImage(data, "image/jpeg")
+		if err != nil {
+			t.Fatalf("orientation %d: %v", tt.orientation, err)
+		}
+		if bytes.Contains(out[variantOriginal], []byte("Exif")) {
+			t.Errorf("orientation %d: EXIF survived", tt.orientation)
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(out[variantOriginal]))
+		if err != nil {
+			t.Fatalf("orientation %d: %v", tt.orientation, err)
+		}
+		if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 32 {
+			t.Fatalf("orientation %d: shown %dx%d, want 64x32", tt.orientation, b.Dx(), b.Dy())
+		}
+
+		for i, p := range []image.Point{{16, 8}, {48, 8}, {16, 24}, {48, 24}} {
+			want := [4]color.RGBA{r, g, b, w}[i]
+			if !closeColor(img.At(p.X, p.Y), want) {
+				t.Errorf("orientation %d: pixel %v is %v, want %v", tt.orientation, p, img.At(p.X, p.Y), want)
+			}
+		}
+	}
+}
+
+func closeColor(c color.Color, want color.RGBA) bool {
+	r, g, b, _ := c.RGBA()
+	near := func(got uint32, want uint8) bool {
+		d := int(got>>8) - int(want)
+		return d > -40 && d < 40
+	}
+	return near(r, want.R) && near(g, want.G) && near(b, want.B)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(append(b, typ...), data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+// pngFixture encodes img and puts chunks right after IHDR.
+func pngFixture(t testing.TB, img image.Image, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	ihdrEnd := 8 + 12 + 13
+	out := append([]byte{}, data[:ihdrEnd]...)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, data[ihdrEnd:]...)
+}
+
+func pngChunkTypes(data []byte) []string {
+	var types []string
+	for i := 8; i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		types = append(types, string(data[i+4:i+8]))
+		i += 12 + n
+	}
+	return types
+}
+
+func TestStripPNG(t *testing.T) {
+	data := pngFixture(t, solidImage(4, 4),
+		pngChunk("gAMA", binary.BigEndian.AppendUint32(nil, 45455)),
+		pngChunk("tEXt", []byte("Comment\x00taken at home")),
+		pngChunk("eXIf", []byte("MM\x00\x2A\x00\x00\x00\x08")),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>")),
+		pngChunk("tIME", []byte{0x07, 0xE8, 1, 2, 3, 4, 5}),
+	)
+
+	out, err := stripPNG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := pngChunkTypes(out)
+	want := []string{"IHDR", "gAMA", "IDAT", "IEND"}
+	if len(got) != len(want) {
+		t.Fatalf("got chunks %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got chunks %v, want %v", got, want)
+		}
+	}
+
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped file does not decode: %v", err)
+	}
+}
+
+func webpChunk(fourcc string, data []byte) []byte {
+	b := binary.LittleEndian.AppendUint32([]byte(fourcc), uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func webpFixture(chunks ...[]byte) []byte {
+	body := append([]byte("WEBP"), bytes.Join(chunks, nil)...)
+	b := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	return append(b, body...)
+}
+
+const (
+	vp8xICC  = 0x20
+	vp8xEXIF = 0x08
+	vp8xXMP  = 0x04
+)
+
+func vp8xChunk(flags byte) []byte {
+	data := make([]byte, 10)
+	data[0] = flags
+	data[4], data[7] = 63, 31 // 64x32 canvas
+	return webpChunk("VP8X", data)
+}
+
+func TestStripWebP(t *testing.T) {
+	icc := webpChunk("ICCP", []byte("profile"))
+	vp8l := webpChunk("VP8L", []byte{0x2F, 0x3F, 0xC0, 0x07, 0x00})
+
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{
+			"exif and xmp",
+			webpFixture(vp8xChunk(vp8xICC|vp8xEXIF|vp8xXMP), icc, vp8l,
+				webpChunk("EXIF", []byte("MM\x00\x2A\x00\x00\x00\x08\x00")),
+				webpChunk("XMP ", []byte("<x:xmpmeta/>"))),
+			webpFixture(vp8xChunk(vp8xICC), icc, vp8l),
+		},
+		{
+			"nothing to strip",
+			webpFixture(vp8xChunk(vp8xICC), icc, vp8l),
+			webpFixture(vp8xChunk(vp8xICC), icc, vp8l),
+		},
+		{
+			"simple format",
+			webpFixture(vp8l),
+			webpFixture(vp8l),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := stripWebP(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, tt.want) {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripMalformed(t *testing.T) {
+	webp := webpFixture(vp8xChunk(vp8xEXIF), webpChunk("EXIF", []byte("exif")))
+	png := pngFixture(t, solidImage(4, 4))
+	jpg := jpegFixture(t, solidImage(4, 4), exifSegment(binary.LittleEndian, 6))
+
+	tests := []struct {
+		name  string
+		strip func([]byte) ([]byte, error)
+		data  []byte
+	}{
+		{"empty jpeg", stripJPEG, nil},
+		{"jpeg segment past end", stripJPEG, append([]byte{0xFF, 0xD8}, jpegSegment(0xE1, []byte("Exif"))[:6]...)},
+		{"jpeg segment shorter than its length", stripJPEG, []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0xFF, 0xDA}},
+		{"jpeg without scan", stripJPEG, jpg[:40]},
+		{"png as jpeg", stripJPEG, png},
+		{"empty png", stripPNG, nil},
+		{"truncated png", stripPNG, png[:len(png)-5]},
+		{"jpeg as png", stripPNG, jpg},
+		{"empty webp", stripWebP, nil},
+		{"truncated webp", stripWebP, webp[:len(webp)-3]},
+		{"webp chunk header cut off", stripWebP, webp[:len(webp)-10]},
+		{"jpeg as webp", stripWebP, jpg},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.strip(tt.data)
+			if err != errBadImage {
+				t.Errorf("got %v, want %v", err, errBadImage)
+			}
+		})
+	}
+}
+
+func FuzzStripJPEG(f *testing.F) {
+	f.Add(jpegFixture(f, solidImage(4, 4), jfifSegment, exifSegment(binary.BigEndian, 6), iccSegment))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		stripJPEG(data)
+		jpegOrientation(data)
+	})
+}
+
+func FuzzStripWebP(f *testing.F) {
+	f.Add(webpFixture(vp8xChunk(vp8xEXIF|vp8xXMP), webpChunk("EXIF", []byte("exif")), webpChunk("XMP ", []byte("xmp"))))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		stripWebP(data)
+	})
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/diamcircle/go/clients/auroraclient"
+	"github.com/diamcircle/go/network"
 )
 
 func likesHandler() {
@@ -13,30 +20,125 @@ func likesHandler() {
 }
 
 func main() {
-	if false {
-		uploadToIPFS(`[{
-			"description": "mangneot the powerful mutant",
-			"image_hash": "http://54.219.7.190:8080/ipfs/QmVPZAuM43hecJDvXHaLKMiZmirN9PHTjW6xrPtjkpwMrq",
-			"like_count": 0,
-			"name": "JOSH",
-			"time": "2024-04-18T10:59:31.79669848+05:30",
-			"user_address": "GCPO4W2CW3BJZS3UPZLOVBMMXKNRPNXK74J7LJOMTKF46FREH5GQFL4Y",
-			"id":"iwbvuddwibvd"
-			
-		  }]`)
-	} else {
-		app := Config{}
-
-		log.Printf("Starting server on port %s", webPort)
-		srv := &http.Server{
-			Addr:    fmt.Sprintf(":%s", webPort),
-			Handler: app.routes(),
-		}
-
-		err := srv.ListenAndServe()
-		if err != nil {
-			panic(err)
-		}
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	command, ok := commands[cmd]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	app, err := newApp()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = command(app, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newApp builds the configuration from the environment.
+func newApp() (*Config, error) {
+	app := &Config{
+		IPFSNode:       envOr("IPFS_API", "https://uploadipfs.diamcircle.io"),
+		MaxUploadBytes: envBytes("UPLOAD_MAX_BYTES", 32<<20),
+		MaxVideoBytes:  envBytes("UPLOAD_MAX_VIDEO_BYTES", 1<<30),
+		UploadDir:      envOr("UPLOAD_DIR", "uploads"),
+		MaxAttachments: envInt("UPLOAD_MAX_ATTACHMENTS", 4),
+		Gateways:       parseGateways(envOr("IPFS_GATEWAYS", defaultGateway)),
+		AdminToken:     envOr("ADMIN_TOKEN", ""),
+		Mirror: NewStorageClient(
+			envOr("STORAGE_URL", "http://10.0.0.15:3001"),
+			envOr("STORAGE_USER", "diamRoot"),
+			envOr("STORAGE_MPIN", "95c21b00cad15f9b1357dafc3bbd8495"),
+		),
+		RewardSeed:        envOr("REWARD_SEED", "SBNBAF32CLQYKVUSGLUKSHSGNKMZPYBKYEWXDL6CAAHMQWD5I3DC2ZV4"),
+		StartingBalance:   envOr("REWARD_STARTING_BALANCE", "50"),
+		NetworkPassphrase: network.TestNetworkPassphrase,
+		Aurora:            auroraclient.DefaultTestNetClient,
+	}
+
+	readLocal, err := strconv.ParseBool(envOr("IPFS_READ_LOCAL", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("IPFS_READ_LOCAL: %w", err)
+	}
+	localNode := ""
+	if readLocal {
+		localNode = app.IPFSNode
+	}
+	app.Reader = NewGatewayClient(app.Gateways, localNode,
+		envOr("IPFS_READ_STRATEGY", readStrategyRace),
+		envDuration("IPFS_READ_TIMEOUT", 10*time.Second))
+
+	err = app.configureStores(envOr("BLOB_PRIMARY", blobStoreIPFS), envOr("BLOB_MIRRORS", mirrorStorageService))
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.configurePinners()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.configurePublishers()
+	if err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+// openDB opens the database. Only one process can hold it, so commands
+// that change the dataset fail while the server is running.
+func (app *Config) openDB() error {
+	db, err := OpenDB(envOr("DB_FILE", "diam.db"))
+	if err != nil {
+		return fmt.Errorf("opening database (is the server running?): %w", err)
+	}
+
+	app.DB = db
+	return nil
+}
+
+func serve(app *Config, args []string) error {
+	err := app.ensureHead(context.Background())
+	if err != nil {
+		return err
+	}
+
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+
+	// Without the posts of the head, the first snapshot would publish a
+	// feed that drops them.
+	err = app.seedDB(context.Background())
+	if err != nil {
+		return fmt.Errorf("seeding database: %w", err)
+	}
+
+	if head, err := ReadCIDFromFile(); err == nil {
+		app.headChanged(head)
+	}
+
+	go app.watchPayments(context.Background())
+	go app.runMirrorQueue(context.Background())
+	go app.runPins(context.Background())
+	go app.runPublisher(context.Background())
+	go app.runRewards(context.Background())
+	go app.runSnapshots(context.Background(), envDuration("DB_SNAPSHOT_EVERY", 30*time.Second))
+
+	log.Printf("Starting server on port %s", webPort)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", webPort),
+		Handler: app.routes(),
 	}
 
+	return srv.ListenAndServe()
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// storedMedia is a media file that has been added to the primary store. Spool is a copy
+// on local disk so the mirror upload can read it again without keeping the
+// file in memory.
+type storedMedia struct {
+	CID      string
+	Name     string
+	MimeType string
+	Size     int64
+	SHA256   string
+	Width    int
+	Height   int
+	Variants map[string]string
+	Video    *videoMeta
+	Poster   string
+	Spool    *os.File
+}
+
+// Close removes the spooled copy.
+func (m *storedMedia) Close() error {
+	if m.Spool == nil {
+		return nil
+	}
+
+	m.Spool.Close()
+	return os.Remove(m.Spool.Name())
+}
+
+// Rewind positions the spooled copy at the start for another read.
+func (m *storedMedia) Rewind() (io.Reader, error) {
+	_, err := m.Spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Spool, nil
+}
+
+// sizeLimitReader fails the read that takes the stream past limit bytes.
+// It also remembers a failure of the source, which the store would
+// otherwise report as its own.
+type sizeLimitReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+	err   error
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, errMediaTooLarge(l.limit)
+	}
+	if err != nil && err != io.EOF {
+		l.err = err
+	}
+
+	return n, err
+}
+
+func (l *sizeLimitReader) exceeded() bool {
+	var mbe *http.MaxBytesError
+	return l.n > l.limit || errors.As(l.err, &mbe)
+}
+
+func errMediaTooLarge(limit int64) error {
+	return apiErrorf(CodePayloadTooLarge, "file size should be at most %s", formatBytes(limit))
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return strconv.FormatInt(n>>30, 10) + "gb"
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return strconv.FormatInt(n>>20, 10) + "mb"
+	}
+
+	return strconv.FormatInt(n, 10) + " bytes"
+}
+
+// uploadLimit is the largest file accepted for a media type. Unknown types
+// get the largest limit; the caller checks again once the type is known.
+func (app *Config) uploadLimit(mediaType string) int64 {
+	switch mediaType {
+	case mediaTypeVideo:
+		return app.MaxVideoBytes
+	case mediaTypeImage:
+		return app.MaxUploadBytes
+	case mediaTypeText:
+		return 0
+	}
+
+	if app.MaxVideoBytes > app.MaxUploadBytes {
+		return app.MaxVideoBytes
+	}
+
+	return app.MaxUploadBytes
+}
+
+// storeMedia streams src into the primary store while hashing it, counting its
+// size and spooling it to disk. Nothing is buffered in memory beyond the
+// copy buffers, except images, which are decoded (see storeImage). The
+// content type is sniffed from the first bytes and, when the media type is
+// already known, checked before anything is added.
+func (app *Config) storeMedia(ctx context.Context, src io.Reader, name, mediaType string) (*storedMedia, error) {
+	limit := app.uploadLimit(mediaType)
+
+	br := bufio.NewReaderSize(src, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	mime := sniffMIME(head)
+	if mediaType != "" {
+		if err := checkMIME(mediaType, mime); err != nil {
+			return nil, err
+		}
+	}
+
+	spool, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	media := &storedMedia{Name: name, MimeType: mime, Spool: spool}
+
+	h := sha256.New()
+	lr := &sizeLimitReader{r: br, limit: limit}
+
+	if canProcessImage(mime) {
+		// Images are held in memory, so they get the image limit even when
+		// the media_type field has not arrived yet.
+		if imageLimit := app.uploadLimit(mediaTypeImage); imageLimit < lr.limit {
+			lr.limit = imageLimit
+		}
+		return app.storeImage(ctx, media, lr)
+	}
+	tee := io.TeeReader(lr, io.MultiWriter(h, spool))
+
+	cid, err := app.Store.Put(ctx, tee)
+	if lr.exceeded() {
+		media.Close()
+		return nil, errMediaTooLarge(limit)
+	}
+	if lr.err != nil {
+		media.Close()
+		return nil, lr.err
+	}
+	if err != nil {
+		media.Close()
+		return nil, app.storeFailed(err)
+	}
+
+	media.CID = cid
+	media.Size = lr.n
+	media.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	if strings.HasPrefix(mime, "video/") {
+		err = app.probeStoredVideo(ctx, media)
+		if err != nil {
+			media.Close()
+			return nil, err
+		}
+	}
+
+	return media, nil
+}
+
+// probeStoredVideo reads the container metadata from the spooled copy, so
+// an MP4 with its index at the end needs no second pass over the network.
+// The poster gets the same metadata stripping as an image upload.
+func (app *Config) probeStoredVideo(ctx context.Context, media *storedMedia) error {
+	meta, err := probeVideo(media.Spool, media.Size, media.MimeType)
+	if err != nil {
+		return err
+	}
+	media.Video = meta
+	media.Width, media.Height = meta.Width, meta.Height
+
+	if meta.Poster == nil {
+		return nil
+	}
+
+	mime := sniffMIME(meta.Poster)
+	if mime != "image/jpeg" && mime != "image/png" {
+		return nil
+	}
+
+	variants, err := processImage(meta.Poster, mime)
+	if err != nil {
+		// A broken cover does not make the video unusable.
+		return nil
+	}
+
+	media.Poster, err = app.Store.Put(ctx, bytes.NewReader(variants[variantOriginal]))
+	if err != nil {
+		return app.storeFailed(err)
+	}
+
+	return nil
+}
+
+// storeImage reads an image into memory, which decoding needs anyway,
+// strips its metadata and stores every variant. The raw upload never
+// leaves the server; the spool holds the stripped original for the mirror
+// upload.
+func (app *Config) storeImage(ctx context.Context, media *storedMedia, lr *sizeLimitReader) (*storedMedia, error) {
+	data, err := io.ReadAll(lr)
+	if lr.exceeded() {
+		media.Close()
+		return nil, errMediaTooLarge(lr.limit)
+	}
+	if err != nil {
+		media.Close()
+		return nil, err
+	}
+
+	variants, err := processImage(data, media.MimeType)
+	if err != nil {
+		media.Close()
+		var ae *APIError
+		if errors.As(err, &ae) {
+			return nil, err
+		}
+		return nil, apiError(CodeUnsupportedMedia, err, "image could not be processed")
+	}
+
+	media.Variants = make(map[string]string, len(variants))
+	for name, b := range variants {
+		cid, err := app.Store.Put(ctx, bytes.NewReader(b))
+		if err != nil {
+			media.Close()
+			return nil, app.storeFailed(err)
+		}
+		media.Variants[name] = cid
+	}
+
+	original := variants[variantOriginal]
+	_, err = media.Spool.Write(original)
+	if err != nil {
+		media.Close()
+		return nil, err
+	}
+
+	sum := sha256.Sum256(original)
+	media.Width, media.Height = imageSize(original, media.MimeType)
+	media.CID = media.Variants[variantOriginal]
+	media.Size = int64(len(original))
+	media.SHA256 = hex.EncodeToString(sum[:])
+
+	return media, nil
+}
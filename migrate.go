@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Posts are upgraded to the current schema whenever they are loaded: from a
+// feed document (see decodeFeed) or from a database written by an older
+// version (see DB.migrate). Each migration upgrades a post by one schema
+// version. They work on the generic JSON of a post rather than on Post,
+// so fields the current types do not know yet are not lost on the way.
+//
+// Schema versions:
+//
+//	0  a bare array of posts, media as a URL in image_hash
+//	1  a document with prev, posts with attachment lists
+//	2  schema_version on the document, every post with a type, mapping and id
+
+type feedMigration struct {
+	Version int
+	Name    string
+	Post    func(post map[string]interface{}) error
+}
+
+var migrations = []feedMigration{
+	{1, "attachment lists and bare CIDs", migrateAttachments},
+	{2, "types, like mappings and ids for old posts", fillPostDefaults},
+}
+
+// feedSchemaVersion is the schema this version writes.
+var feedSchemaVersion = migrations[len(migrations)-1].Version
+
+// migratePosts upgrades the JSON array of posts from schema version from to
+// the current one.
+func migratePosts(posts []byte, from int) ([]byte, error) {
+	if from == feedSchemaVersion {
+		return posts, nil
+	}
+	if from > feedSchemaVersion {
+		return nil, fmt.Errorf("schema version %d is newer than this server (%d)", from, feedSchemaVersion)
+	}
+
+	var list []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(posts))
+	decoder.UseNumber()
+	err := decoder.Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= from {
+			continue
+		}
+		for i, p := range list {
+			err := m.Post(p)
+			if err != nil {
+				return nil, fmt.Errorf("migration %d (%s), post %d: %w", m.Version, m.Name, i, err)
+			}
+		}
+	}
+
+	return json.Marshal(list)
+}
+
+// pendingMigrations names the migrations a document at version from needs.
+func pendingMigrations(from int) []string {
+	var names []string
+	for _, m := range migrations {
+		if m.Version > from {
+			names = append(names, fmt.Sprintf("%d: %s", m.Version, m.Name))
+		}
+	}
+
+	return names
+}
+
+// postField decodes the field key of a generic post into out and reports
+// whether it was there.
+func postField(post map[string]interface{}, key string, out interface{}) bool {
+	v, ok := post[key]
+	if !ok || v == nil {
+		return false
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+
+	return json.Unmarshal(data, out) == nil
+}
+
+// migrateAttachments moves the single file of posts from before attachment
+// lists into a list, and reduces gateway URLs to bare CIDs.
+func migrateAttachments(post map[string]interface{}) error {
+	data, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+
+	var imageHash string
+	var attachments []Attachment
+	postField(post, "image_hash", &imageHash)
+	postField(post, "attachments", &attachments)
+
+	imageHash, attachments = migrateMedia(data, imageHash, attachments)
+	post["image_hash"] = imageHash
+	if len(attachments) > 0 {
+		post["attachments"] = attachments
+	}
+
+	return nil
+}
+
+// fillPostDefaults gives posts from before types, like mappings and ids the
+// values their zero values used to stand for, so they can be filtered and
+// liked like any other post.
+func fillPostDefaults(post map[string]interface{}) error {
+	var attachments []Attachment
+	postField(post, "attachments", &attachments)
+
+	var postType int
+	postField(post, "type", &postType)
+	if postType == 0 {
+		postType = 1
+		if len(attachments) > 0 {
+			// Before videos every file was an image.
+			postType = 2
+			if strings.HasPrefix(attachments[0].MimeType, "video/") {
+				postType = 3
+			}
+		}
+		post["type"] = postType
+	}
+
+	var mapping map[string]int
+	if !postField(post, "mapping", &mapping) || mapping == nil {
+		post["mapping"] = map[string]int{}
+	}
+
+	var id string
+	postField(post, "id", &id)
+	if id == "" {
+		post["id"] = legacyPostID(post)
+	}
+
+	return nil
+}
+
+// legacyPostID derives an id for a post that never had one from its
+// content, so every load of the post gives it the same id.
+func legacyPostID(post map[string]interface{}) string {
+	data, _ := json.Marshal(post)
+	sum := sha256.Sum256(data)
+
+	id := make([]byte, legacyPostIDLength)
+	for i := range id {
+		id[i] = charset[int(sum[i])%len(charset)]
+	}
+
+	return string(id)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Media is mirrored to the BLOB_MIRRORS targets in the background. A post
+// is published as soon as it is in the primary store; each of its files
+// becomes a job per target that is retried with backoff and moved to the
+// dead-letter list once it runs out of attempts, where an admin can inspect
+// and replay it.
+
+const (
+	mirrorBaseBackoff = 30 * time.Second
+	mirrorMaxBackoff  = time.Hour
+	mirrorPollEvery   = 15 * time.Second
+)
+
+var (
+	mirrorMutex sync.Mutex
+	mirrorWake  = make(chan struct{}, 1)
+)
+
+type MirrorJob struct {
+	ID          string `json:"id"`
+	PostID      string `json:"post_id"`
+	UserAddress string `json:"user_address"`
+	FileName    string `json:"file_name"`
+	CID         string `json:"cid"`
+	// Target is the mirror the job sends to. Jobs queued before there was
+	// a choice have none and go to the storage service.
+	Target      string    `json:"target,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type MirrorQueue struct {
+	Pending []MirrorJob `json:"pending"`
+	Dead    []MirrorJob `json:"dead"`
+}
+
+func mirrorQueueFile() string {
+	return envOr("MIRROR_QUEUE_FILE", "mirror_queue.json")
+}
+
+// mirrorFile is where a job keeps its copy of the media until it is sent.
+func (app *Config) mirrorFile(id string) string {
+	return filepath.Join(app.UploadDir, "mirror", id)
+}
+
+func readMirrorQueue() (MirrorQueue, error) {
+	var queue MirrorQueue
+
+	data, err := os.ReadFile(mirrorQueueFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return queue, nil
+	}
+	if err != nil {
+		return queue, err
+	}
+
+	err = json.Unmarshal(data, &queue)
+	return queue, err
+}
+
+func writeMirrorQueue(queue MirrorQueue) error {
+	return writeJSONFile(mirrorQueueFile(), queue)
+}
+
+// updateMirrorQueue applies fn to the queue and writes it back while holding
+// the queue lock.
+func updateMirrorQueue(fn func(*MirrorQueue) error) error {
+	mirrorMutex.Lock()
+	defer mirrorMutex.Unlock()
+
+	queue, err := readMirrorQueue()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&queue)
+	if err != nil {
+		return err
+	}
+
+	return writeMirrorQueue(queue)
+}
+
+func wakeMirror() {
+	select {
+	case mirrorWake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueMirror queues the media for every mirror target.
+func (app *Config) enqueueMirror(postID, userAddress string, media *storedMedia) error {
+	for _, target := range app.MirrorTargets {
+		err := app.enqueueMirrorJob(postID, userAddress, target, media)
+		if err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+	}
+
+	return nil
+}
+
+// enqueueMirrorJob copies the spooled media next to the queue, since the
+// spool is removed when the request ends, and schedules it for upload.
+func (app *Config) enqueueMirrorJob(postID, userAddress, target string, media *storedMedia) error {
+	job := MirrorJob{
+		ID:          StringRandom(16),
+		PostID:      postID,
+		UserAddress: userAddress,
+		FileName:    media.Name,
+		CID:         media.CID,
+		Target:      target,
+		NextAttempt: time.Now(),
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	err := os.MkdirAll(filepath.Dir(app.mirrorFile(job.ID)), 0o700)
+	if err != nil {
+		return err
+	}
+
+	src, err := media.Rewind()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(app.mirrorFile(job.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(app.mirrorFile(job.ID))
+		return err
+	}
+
+	err = updateMirrorQueue(func(q *MirrorQueue) error {
+		q.Pending = append(q.Pending, job)
+		return nil
+	})
+	if err != nil {
+		os.Remove(app.mirrorFile(job.ID))
+		return err
+	}
+
+	wakeMirror()
+	return nil
+}
+
+// runMirrorQueue works through due jobs until ctx is cancelled.
+func (app *Config) runMirrorQueue(ctx context.Context) {
+	maxAttempts := envInt("MIRROR_MAX_ATTEMPTS", 10)
+	ticker := time.NewTicker(mirrorPollEvery)
+	defer ticker.Stop()
+
+	for {
+		app.processMirrorJobs(ctx, maxAttempts)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-mirrorWake:
+		}
+	}
+}
+
+func (app *Config) processMirrorJobs(ctx context.Context, maxAttempts int) {
+	mirrorMutex.Lock()
+	queue, err := readMirrorQueue()
+	mirrorMutex.Unlock()
+	if err != nil {
+		log.Println("mirror queue:", err)
+		return
+	}
+
+	now := time.Now()
+	for _, job := range queue.Pending {
+		if job.NextAttempt.After(now) {
+			continue
+		}
+
+		err = app.sendMirrorJob(ctx, job)
+		app.finishMirrorJob(job.ID, err, maxAttempts)
+	}
+}
+
+func (app *Config) sendMirrorJob(ctx context.Context, job MirrorJob) error {
+	file, err := os.Open(app.mirrorFile(job.ID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if job.Target == "" || job.Target == mirrorStorageService {
+		return app.Mirror.Upload(ctx, job.UserAddress, file, job.FileName)
+	}
+
+	store, ok := app.MirrorStores[job.Target]
+	if !ok {
+		return fmt.Errorf("mirror target %q is not configured", job.Target)
+	}
+
+	_, err = store.Put(ctx, file)
+	return err
+}
+
+// finishMirrorJob removes a job that went through, and reschedules or
+// dead-letters one that failed.
+func (app *Config) finishMirrorJob(id string, sendErr error, maxAttempts int) {
+	err := updateMirrorQueue(func(q *MirrorQueue) error {
+		for i := range q.Pending {
+			if q.Pending[i].ID != id {
+				continue
+			}
+
+			job := q.Pending[i]
+			q.Pending = append(q.Pending[:i], q.Pending[i+1:]...)
+
+			if sendErr == nil {
+				os.Remove(app.mirrorFile(id))
+				return nil
+			}
+
+			job.Attempts++
+			job.LastError = sendErr.Error()
+			job.UpdatedAt = time.Now()
+
+			if job.Attempts >= maxAttempts {
+				log.Printf("mirror job %s for post %s failed %d times: %v", id, job.PostID, job.Attempts, sendErr)
+				q.Dead = append(q.Dead, job)
+				return nil
+			}
+
+			backoff := mirrorBaseBackoff << (job.Attempts - 1)
+			if backoff > mirrorMaxBackoff || backoff <= 0 {
+				backoff = mirrorMaxBackoff
+			}
+			job.NextAttempt = job.UpdatedAt.Add(backoff)
+			q.Pending = append(q.Pending, job)
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("mirror queue:", err)
+	}
+}
+
+func (app *Config) listMirrorJobs(w http.ResponseWriter, r *http.Request) {
+	mirrorMutex.Lock()
+	queue, err := readMirrorQueue()
+	mirrorMutex.Unlock()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if queue.Pending == nil {
+		queue.Pending = []MirrorJob{}
+	}
+	if queue.Dead == nil {
+		queue.Dead = []MirrorJob{}
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "mirror jobs",
+		Data:    queue,
+	})
+}
+
+// replayMirrorJob moves a dead job back to the queue with fresh attempts.
+func (app *Config) replayMirrorJob(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var job MirrorJob
+	err := updateMirrorQueue(func(q *MirrorQueue) error {
+		for i := range q.Dead {
+			if q.Dead[i].ID == id {
+				job = q.Dead[i]
+				q.Dead = append(q.Dead[:i], q.Dead[i+1:]...)
+
+				job.Attempts = 0
+				job.NextAttempt = time.Now()
+				job.UpdatedAt = time.Now()
+				q.Pending = append(q.Pending, job)
+				return nil
+			}
+		}
+		return errJobNotFound
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	wakeMirror()
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "mirror job queued",
+		Data:    job,
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/diamcircle/go/amount"
+	"github.com/diamcircle/go/txnbuild"
+)
+
+const (
+	paymentPending   = "pending"
+	paymentConfirmed = "confirmed"
+	paymentFailed    = "failed"
+
+	paymentKindReward = "reward"
+	paymentKindTip    = "tip"
+
+	paymentMethodPayment       = "payment"
+	paymentMethodCreateAccount = "create_account"
+
+	// maxMemoText is how many bytes a text memo holds.
+	maxMemoText = 28
+)
+
+var (
+	ledgerMutex sync.Mutex
+)
+
+// PaymentRecord tracks a payment we submitted or prepared until the chain
+// watcher sees it land in a ledger.
+type PaymentRecord struct {
+	TxHash    string    `json:"tx_hash"`
+	PostID    string    `json:"post_id"`
+	Kind      string    `json:"kind"`
+	Method    string    `json:"method"`
+	Memo      string    `json:"memo"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Asset     string    `json:"asset"`
+	Amount    string    `json:"amount"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// ValidUntil is the upper time bound of the transaction, after which
+	// it can no longer be applied.
+	ValidUntil time.Time `json:"valid_until,omitempty"`
+}
+
+// expired reports whether the transaction can no longer make it into a
+// ledger. Records from before ValidUntil was kept are tips, which were
+// built with a 300s bound, or rewards, which had none.
+func (rec PaymentRecord) expired(now time.Time) bool {
+	if rec.ValidUntil.IsZero() {
+		return rec.Kind == paymentKindTip && now.Sub(rec.CreatedAt) > pendingTimeout
+	}
+
+	return now.After(rec.ValidUntil.Add(ledgerCloseMargin))
+}
+
+type PaymentLedger struct {
+	Records []PaymentRecord `json:"records"`
+	// Cursors holds the last streamed paging token per watched account so
+	// the watcher resumes where it stopped after a restart.
+	Cursors map[string]string `json:"cursors"`
+}
+
+// paymentMemo returns the memo of a payment for a post, and the memo as the
+// chain reports it, which is what the ledger records and the watcher
+// matches. It is "kind:id" as text when that fits; legacy IDs too long for
+// it get a hash memo of the SHA-256 of that text, reported in base64.
+func paymentMemo(kind, postID string) (txnbuild.Memo, string) {
+	text := kind + ":" + postID
+	if len(text) <= maxMemoText {
+		return txnbuild.MemoText(text), text
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	return txnbuild.MemoHash(sum), base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func ledgerFile() string {
+	return envOr("PAYMENTS_FILE", "payments.json")
+}
+
+func readLedger() (PaymentLedger, error) {
+	ledger := PaymentLedger{Cursors: make(map[string]string)}
+
+	data, err := os.ReadFile(ledgerFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return ledger, nil
+	}
+	if err != nil {
+		return ledger, err
+	}
+
+	err = json.Unmarshal(data, &ledger)
+	if err != nil {
+		return ledger, err
+	}
+
+	if ledger.Cursors == nil {
+		ledger.Cursors = make(map[string]string)
+	}
+
+	return ledger, nil
+}
+
+func writeLedger(ledger PaymentLedger) error {
+	return writeJSONFile(ledgerFile(), ledger)
+}
+
+// updateLedger applies fn to the ledger and writes it back while holding the
+// ledger lock.
+func updateLedger(fn func(*PaymentLedger) error) error {
+	ledgerMutex.Lock()
+	defer ledgerMutex.Unlock()
+
+	ledger, err := readLedger()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&ledger)
+	if err != nil {
+		return err
+	}
+
+	return writeLedger(ledger)
+}
+
+func recordPayment(rec PaymentRecord) error {
+	now := time.Now()
+	rec.Status = paymentPending
+	rec.CreatedAt = now
+	rec.UpdatedAt = now
+
+	return updateLedger(func(l *PaymentLedger) error {
+		l.Records = append(l.Records, rec)
+		return nil
+	})
+}
+
+// setPaymentStatus moves a pending record to a final status. Records that
+// already reached a final status are left alone.
+func setPaymentStatus(txHash, status, reason string) error {
+	return updateLedger(func(l *PaymentLedger) error {
+		for i := range l.Records {
+			if l.Records[i].TxHash == txHash && l.Records[i].Status == paymentPending {
+				l.Records[i].Status = status
+				l.Records[i].Error = reason
+				l.Records[i].UpdatedAt = time.Now()
+			}
+		}
+		return nil
+	})
+}
+
+// rewardPayment returns the reward payment for a post that is pending or
+// went through, or nil if there is none. Failed records are final: their
+// transactions were refused or can no longer be applied.
+func rewardPayment(postID string) (*PaymentRecord, error) {
+	ledgerMutex.Lock()
+	ledger, err := readLedger()
+	ledgerMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range ledger.Records {
+		if rec.PostID == postID && rec.Kind == paymentKindReward && rec.Status != paymentFailed {
+			return &rec, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// postEarnings sums the confirmed payments for a post, per asset.
+func postEarnings(postID string) (map[string]string, error) {
+	ledgerMutex.Lock()
+	ledger, err := readLedger()
+	ledgerMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]int64)
+	for _, rec := range ledger.Records {
+		if rec.PostID != postID || rec.Status != paymentConfirmed {
+			continue
+		}
+
+		v, err := amount.ParseInt64(rec.Amount)
+		if err != nil {
+			return nil, err
+		}
+		sums[rec.Asset] += v
+	}
+
+	totals := make(map[string]string, len(sums))
+	for asset, v := range sums {
+		totals[asset] = amount.StringFromInt64(v)
+	}
+
+	return totals, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamcircle/go/txnbuild"
+)
+
+func TestPaymentMemo(t *testing.T) {
+	newID, err := newPostID(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		kind string
+		id   string
+		text bool
+	}{
+		{"new id reward", paymentKindReward, newID, true},
+		{"new id tip", paymentKindTip, newID, true},
+		{"legacy id", paymentKindReward, "abcdefghij", true},
+		{"long legacy id reward", paymentKindReward, strings.Repeat("a", 22), false},
+		{"long legacy id tip", paymentKindTip, strings.Repeat("a", 30), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memo, reported := paymentMemo(tt.kind, tt.id)
+
+			want := tt.kind + ":" + tt.id
+			if tt.text {
+				if memo != txnbuild.MemoText(want) || reported != want {
+					t.Errorf("got %#v reported as %q, want text memo %q", memo, reported, want)
+				}
+				if len(want) > maxMemoText {
+					t.Errorf("text memo %q is longer than %d bytes", want, maxMemoText)
+				}
+				return
+			}
+
+			sum := sha256.Sum256([]byte(want))
+			if memo != txnbuild.MemoHash(sum) || reported != base64.StdEncoding.EncodeToString(sum[:]) {
+				t.Errorf("got %#v reported as %q, want the hash of %q", memo, reported, want)
+			}
+		})
+	}
+}
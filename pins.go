@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// The pin registry lists every CID that must stay available: the media of
+// each post and the feed roots. Request handlers only record what is
+// wanted; a background worker pins it on every configured pinner, unpins
+// roots once they have been superseded for the retention window, and
+// periodically checks that nothing went missing.
+
+const (
+	pinKindMedia = "media"
+	pinKindRoot  = "root"
+
+	pinSyncEvery = time.Minute
+)
+
+var (
+	pinMutex sync.Mutex
+	pinWake  = make(chan struct{}, 1)
+)
+
+// Pinner keeps content pinned on one IPFS node or pinning service.
+type Pinner interface {
+	Name() string
+	Pin(ctx context.Context, cid, name string) error
+	Unpin(ctx context.Context, cid string) error
+	IsPinned(ctx context.Context, cid string) (bool, error)
+}
+
+type PinRecord struct {
+	CID          string               `json:"cid"`
+	Kind         string               `json:"kind"`
+	PostID       string               `json:"post_id,omitempty"`
+	CreatedAt    time.Time            `json:"created_at"`
+	SupersededAt *time.Time           `json:"superseded_at,omitempty"`
+	Pinned       map[string]time.Time `json:"pinned"`
+	LastError    string               `json:"last_error,omitempty"`
+}
+
+// PinReport is the outcome of the last reconciliation.
+type PinReport struct {
+	CheckedAt time.Time    `json:"checked_at"`
+	Checked   int          `json:"checked"`
+	Missing   []MissingPin `json:"missing"`
+}
+
+type MissingPin struct {
+	CID    string `json:"cid"`
+	Kind   string `json:"kind"`
+	PostID string `json:"post_id,omitempty"`
+	Pinner string `json:"pinner"`
+	Error  string `json:"error,omitempty"`
+}
+
+type PinRegistry struct {
+	Pins       []PinRecord `json:"pins"`
+	LastReport *PinReport  `json:"last_report,omitempty"`
+}
+
+func pinsFile() string {
+	return envOr("PINS_FILE", "pins.json")
+}
+
+func readPins() (PinRegistry, error) {
+	var registry PinRegistry
+
+	data, err := os.ReadFile(pinsFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return registry, nil
+	}
+	if err != nil {
+		return registry, err
+	}
+
+	err = json.Unmarshal(data, &registry)
+	return registry, err
+}
+
+func writePins(registry PinRegistry) error {
+	return writeJSONFile(pinsFile(), registry)
+}
+
+// updatePins applies fn to the registry and writes it back while holding
+// the registry lock.
+func updatePins(fn func(*PinRegistry) error) error {
+	pinMutex.Lock()
+	defer pinMutex.Unlock()
+
+	registry, err := readPins()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&registry)
+	if err != nil {
+		return err
+	}
+
+	return writePins(registry)
+}
+
+func wakePins() {
+	select {
+	case pinWake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *PinRegistry) find(cid string) *PinRecord {
+	for i := range r.Pins {
+		if r.Pins[i].CID == cid {
+			return &r.Pins[i]
+		}
+	}
+
+	return nil
+}
+
+// pinMedia records the media files of a post. Keys of other blob stores are
+// not CIDs, so there is nothing to pin unless IPFS is the primary store.
+func (app *Config) pinMedia(postID string, attachments []Attachment) {
+	if len(app.Pinners) == 0 || app.Store.Name() != blobStoreIPFS {
+		return
+	}
+
+	var cids []string
+	for _, a := range attachments {
+		cids = append(cids, a.CID)
+		for _, cid := range a.Variants {
+			cids = append(cids, cid)
+		}
+		if a.Poster != "" {
+			cids = append(cids, a.Poster)
+		}
+	}
+
+	err := updatePins(func(r *PinRegistry) error {
+		for _, cid := range cids {
+			if r.find(cid) == nil {
+				r.Pins = append(r.Pins, PinRecord{
+					CID:       cid,
+					Kind:      pinKindMedia,
+					PostID:    postID,
+					CreatedAt: time.Now(),
+					Pinned:    make(map[string]time.Time),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("post %s: could not record pins: %v", postID, err)
+	}
+
+	wakePins()
+}
+
+// pinRoot records a new feed root and starts the retention window of the
+// roots it supersedes.
+func (app *Config) pinRoot(cid string) {
+	if len(app.Pinners) == 0 {
+		return
+	}
+
+	err := updatePins(func(r *PinRegistry) error {
+		now := time.Now()
+		for i := range r.Pins {
+			p := &r.Pins[i]
+			if p.Kind == pinKindRoot && p.CID != cid && p.SupersededAt == nil {
+				p.SupersededAt = &now
+			}
+		}
+
+		if p := r.find(cid); p != nil {
+			p.SupersededAt = nil
+			return nil
+		}
+
+		r.Pins = append(r.Pins, PinRecord{
+			CID:       cid,
+			Kind:      pinKindRoot,
+			CreatedAt: now,
+			Pinned:    make(map[string]time.Time),
+		})
+		return nil
+	})
+	if err != nil {
+		log.Printf("root %s: could not record pin: %v", cid, err)
+	}
+
+	wakePins()
+}
+
+// runPins keeps the pinners in line with the registry until ctx is
+// cancelled.
+func (app *Config) runPins(ctx context.Context) {
+	if len(app.Pinners) == 0 {
+		return
+	}
+
+	retention := envDuration("PIN_ROOT_RETENTION", 7*24*time.Hour)
+	reconcileEvery := envDuration("PIN_RECONCILE_EVERY", time.Hour)
+
+	syncTick := time.NewTicker(pinSyncEvery)
+	defer syncTick.Stop()
+	reconcileTick := time.NewTicker(reconcileEvery)
+	defer reconcileTick.Stop()
+
+	for {
+		app.syncPins(ctx, retention)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-syncTick.C:
+		case <-pinWake:
+		case <-reconcileTick.C:
+			_, err := app.reconcilePins(ctx)
+			if err != nil {
+				log.Println("pin reconciliation:", err)
+			}
+		}
+	}
+}
+
+// syncPins pins what is not pinned yet and drops roots past retention.
+func (app *Config) syncPins(ctx context.Context, retention time.Duration) {
+	pinMutex.Lock()
+	registry, err := readPins()
+	pinMutex.Unlock()
+	if err != nil {
+		log.Println("pins:", err)
+		return
+	}
+
+	pinned := make(map[string]map[string]time.Time)
+	failed := make(map[string]string)
+	var expired []string
+
+	for _, p := range registry.Pins {
+		if p.SupersededAt != nil && time.Since(*p.SupersededAt) > retention {
+			err := app.unpinAll(ctx, p.CID)
+			if err != nil {
+				failed[p.CID] = err.Error()
+				continue
+			}
+			expired = append(expired, p.CID)
+			continue
+		}
+
+		for _, pinner := range app.Pinners {
+			if _, ok := p.Pinned[pinner.Name()]; ok {
+				continue
+			}
+
+			err := pinner.Pin(ctx, p.CID, p.Kind+":"+p.PostID)
+			if err != nil {
+				failed[p.CID] = pinner.Name() + ": " + err.Error()
+				continue
+			}
+			if pinned[p.CID] == nil {
+				pinned[p.CID] = make(map[string]time.Time)
+			}
+			pinned[p.CID][pinner.Name()] = time.Now()
+		}
+	}
+
+	if len(pinned) == 0 && len(failed) == 0 && len(expired) == 0 {
+		return
+	}
+
+	err = updatePins(func(r *PinRegistry) error {
+		for cid, by := range pinned {
+			if p := r.find(cid); p != nil {
+				if p.Pinned == nil {
+					p.Pinned = make(map[string]time.Time)
+				}
+				for name, at := range by {
+					p.Pinned[name] = at
+				}
+				p.LastError = ""
+			}
+		}
+		for cid, reason := range failed {
+			if p := r.find(cid); p != nil {
+				p.LastError = reason
+			}
+		}
+
+		gone := make(map[string]bool, len(expired))
+		for _, cid := range expired {
+			gone[cid] = true
+		}
+		kept := r.Pins[:0]
+		for _, p := range r.Pins {
+			// A root that became the head again while we were unpinning
+			// is kept; the next sync pins it again.
+			if gone[p.CID] && p.SupersededAt != nil {
+				continue
+			}
+			if gone[p.CID] {
+				p.Pinned = make(map[string]time.Time)
+			}
+			kept = append(kept, p)
+		}
+		r.Pins = kept
+		return nil
+	})
+	if err != nil {
+		log.Println("pins:", err)
+	}
+}
+
+func (app *Config) unpinAll(ctx context.Context, cid string) error {
+	for _, pinner := range app.Pinners {
+		err := pinner.Unpin(ctx, cid)
+		if err != nil {
+			return fmt.Errorf("%s: %w", pinner.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// reconcilePins asks every pinner about every wanted CID and reports the
+// ones that went missing. Missing pins are marked unpinned so the next sync
+// pins them again.
+func (app *Config) reconcilePins(ctx context.Context) (*PinReport, error) {
+	pinMutex.Lock()
+	registry, err := readPins()
+	pinMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PinReport{CheckedAt: time.Now(), Missing: []MissingPin{}}
+	for _, p := range registry.Pins {
+		if p.SupersededAt != nil {
+			continue
+		}
+		report.Checked++
+
+		for _, pinner := range app.Pinners {
+			if _, ok := p.Pinned[pinner.Name()]; !ok {
+				// Not pinned yet; syncPins is on it.
+				continue
+			}
+
+			ok, err := pinner.IsPinned(ctx, p.CID)
+			if err == nil && ok {
+				continue
+			}
+
+			missing := MissingPin{CID: p.CID, Kind: p.Kind, PostID: p.PostID, Pinner: pinner.Name()}
+			if err != nil {
+				missing.Error = err.Error()
+			}
+			report.Missing = append(report.Missing, missing)
+		}
+	}
+
+	for _, m := range report.Missing {
+		log.Printf("pin missing: %s %s (post %q) on %s %s", m.Kind, m.CID, m.PostID, m.Pinner, m.Error)
+	}
+
+	err = updatePins(func(r *PinRegistry) error {
+		for _, m := range report.Missing {
+			if p := r.find(m.CID); p != nil && m.Error == "" {
+				delete(p.Pinned, m.Pinner)
+			}
+		}
+		r.LastReport = report
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wakePins()
+	return report, nil
+}
+
+func (app *Config) listPins(w http.ResponseWriter, r *http.Request) {
+	pinMutex.Lock()
+	registry, err := readPins()
+	pinMutex.Unlock()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if registry.Pins == nil {
+		registry.Pins = []PinRecord{}
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: fmt.Sprintf("%d pins", len(registry.Pins)),
+		Data:    registry,
+	})
+}
+
+func (app *Config) reconcilePinsNow(w http.ResponseWriter, r *http.Request) {
+	report, err := app.reconcilePins(r.Context())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: fmt.Sprintf("%d of %d pins missing", len(report.Missing), report.Checked),
+		Data:    report,
+	})
+}
+
+// configurePinners sets up the local node (PIN_LOCAL, on by default) and
+// the remote pinning services named in PIN_SERVICES, each configured by
+// PIN_<NAME>_ENDPOINT and PIN_<NAME>_TOKEN.
+func (app *Config) configurePinners() error {
+	local, err := strconv.ParseBool(envOr("PIN_LOCAL", "true"))
+	if err != nil {
+		return fmt.Errorf("PIN_LOCAL: %w", err)
+	}
+	if local {
+		app.Pinners = append(app.Pinners, &LocalPinner{Node: app.IPFSNode})
+	}
+
+	for _, name := range strings.Split(envOr("PIN_SERVICES", ""), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		prefix := "PIN_" + strings.ToUpper(name) + "_"
+		endpoint := envOr(prefix+"ENDPOINT", "")
+		if endpoint == "" {
+			return fmt.Errorf("pinning service %s needs %sENDPOINT", name, prefix)
+		}
+
+		app.Pinners = append(app.Pinners, &RemotePinner{
+			ServiceName: name,
+			Endpoint:    strings.TrimRight(endpoint, "/"),
+			Token:       envOr(prefix+"TOKEN", ""),
+			HTTP:        &http.Client{Timeout: time.Minute},
+		})
+	}
+
+	return nil
+}
+
+// LocalPinner pins on the IPFS node behind the HTTP API.
+type LocalPinner struct {
+	Node string
+}
+
+func (p *LocalPinner) Name() string { return "local" }
+
+func (p *LocalPinner) Pin(ctx context.Context, cid, name string) error {
+	return shell.NewShell(p.Node).Request("pin/add", cid).
+		Option("recursive", true).
+		Exec(ctx, nil)
+}
+
+func (p *LocalPinner) Unpin(ctx context.Context, cid string) error {
+	err := shell.NewShell(p.Node).Request("pin/rm", cid).
+		Option("recursive", true).
+		Exec(ctx, nil)
+	if err != nil && strings.Contains(err.Error(), "not pinned") {
+		return nil
+	}
+
+	return err
+}
+
+func (p *LocalPinner) IsPinned(ctx context.Context, cid string) (bool, error) {
+	var raw struct{ Keys map[string]shell.PinInfo }
+	err := shell.NewShell(p.Node).Request("pin/ls", cid).
+		Option("type", shell.RecursivePin).
+		Exec(ctx, &raw)
+	if err != nil {
+		if strings.Contains(err.Error(), "not pinned") {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return len(raw.Keys) > 0, nil
+}
+
+// RemotePinner speaks the IPFS Pinning Service API.
+type RemotePinner struct {
+	ServiceName string
+	Endpoint    string
+	Token       string
+	HTTP        *http.Client
+}
+
+type pinStatus struct {
+	RequestID string `json:"requestid"`
+	Status    string `json:"status"`
+}
+
+func (p *RemotePinner) Name() string { return p.ServiceName }
+
+func (p *RemotePinner) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = strings.NewReader(string(b))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.Endpoint+path, r)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := p.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s answered %s: %s", method, path, res.Status, data)
+	}
+
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+
+	return nil
+}
+
+// requests lists the pin requests for cid in the given statuses.
+func (p *RemotePinner) requests(ctx context.Context, cid, statuses string) ([]pinStatus, error) {
+	var list struct {
+		Results []pinStatus `json:"results"`
+	}
+
+	q := url.Values{"cid": {cid}, "status": {statuses}}
+	err := p.do(ctx, http.MethodGet, "/pins?"+q.Encode(), nil, &list)
+	return list.Results, err
+}
+
+func (p *RemotePinner) Pin(ctx context.Context, cid, name string) error {
+	existing, err := p.requests(ctx, cid, "queued,pinning,pinned")
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	return p.do(ctx, http.MethodPost, "/pins", map[string]string{"cid": cid, "name": name}, nil)
+}
+
+func (p *RemotePinner) Unpin(ctx context.Context, cid string) error {
+	existing, err := p.requests(ctx, cid, "queued,pinning,pinned,failed")
+	if err != nil {
+		return err
+	}
+
+	for _, s := range existing {
+		err = p.do(ctx, http.MethodDelete, "/pins/"+url.PathEscape(s.RequestID), nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsPinned counts a request the service is still working on as pinned;
+// only a failed or missing request is reported.
+func (p *RemotePinner) IsPinned(ctx context.Context, cid string) (bool, error) {
+	existing, err := p.requests(ctx, cid, "queued,pinning,pinned")
+	if err != nil {
+		return false, err
+	}
+
+	return len(existing) > 0, nil
+}
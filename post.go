@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+	"time"
+)
+
+// Post IDs are 21 base62 characters encoding 6 bytes of Unix time in
+// milliseconds followed by 9 random bytes, so they sort by creation time and
+// two servers creating posts in the same millisecond do not clash. They are
+// short enough that "reward:" plus an ID fits the 28 bytes of a text memo.
+//
+// Posts created before these IDs keep theirs, which are alphanumeric but
+// of no fixed length (most have 10 characters, the oldest more). Every
+// lookup treats an ID as an opaque string, the database refuses an ID that
+// is taken, and payments and likes already recorded against old IDs stay
+// valid. Payments for IDs too long for a text memo use a hash memo (see
+// paymentMemo).
+const (
+	postIDLength       = 21
+	legacyPostIDLength = 10
+	postIDRandomBytes  = 9
+	base62Alphabet     = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// newPostID returns a new post ID for a post created at t.
+func newPostID(t time.Time) (string, error) {
+	b := make([]byte, 6+postIDRandomBytes)
+
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+
+	_, err := rand.Read(b[6:])
+	if err != nil {
+		return "", err
+	}
+
+	n := new(big.Int).SetBytes(b)
+	mod := new(big.Int)
+	radix := big.NewInt(int64(len(base62Alphabet)))
+
+	// Fixed width, most significant digit first, so IDs sort as strings.
+	id := make([]byte, postIDLength)
+	for i := len(id) - 1; i >= 0; i-- {
+		n.DivMod(n, radix, mod)
+		id[i] = base62Alphabet[mod.Int64()]
+	}
+
+	return string(id), nil
+}
+
+// validPostID accepts new and legacy post IDs.
+func validPostID(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Post is a post as the server stores and publishes it. Its JSON names are
+// the feed schema (see migrations), which other readers of the feed depend
+// on; what clients of the API see is a separate type per API version, built
+// by the mapping functions below.
+type Post struct {
+	Id          string         `json:"id"`
+	UserAddress string         `json:"user_address"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Time        time.Time      `json:"time"`
+	Type        int            `json:"type"`
+	ImageHash   string         `json:"image_hash"`
+	Attachments []Attachment   `json:"attachments,omitempty"`
+	LikeCount   int            `json:"like_count"`
+	Likers      map[string]int `json:"mapping"`
+	Campaign    string         `json:"campaign,omitempty"`
+}
+
+// LikedBy reports whether address has liked the post.
+func (p *Post) LikedBy(address string) bool {
+	_, ok := p.Likers[address]
+	return ok
+}
+
+// PostV1 is a post in API responses. It keeps every field the post
+// endpoints have always returned and adds what clients need to act on a
+// post. A change that would break these clients gets a new type and mapping
+// function instead.
+type PostV1 struct {
+	ID              string       `json:"id"`
+	Name            string       `json:"name"`
+	Description     string       `json:"description"`
+	UserAddress     string       `json:"user_address"`
+	Time            time.Time    `json:"time"`
+	Type            int          `json:"type"`
+	ImageHash       string       `json:"image_hash"`
+	Attachments     []Attachment `json:"attachments,omitempty"`
+	Campaign        string       `json:"campaign,omitempty"`
+	LikeCount       int          `json:"like_count"`
+	AttachmentCount int          `json:"attachment_count"`
+	// LikedByViewer is whether the caller, named by viewer_address in the
+	// request, has liked the post.
+	LikedByViewer bool `json:"liked_by_viewer"`
+}
+
+// postV1 maps a post to its v1 response for viewer, which may be empty.
+func (app *Config) postV1(p Post, viewer string) PostV1 {
+	out := PostV1{
+		ID:              p.Id,
+		Name:            p.Name,
+		Description:     p.Description,
+		UserAddress:     p.UserAddress,
+		Time:            p.Time,
+		Type:            p.Type,
+		ImageHash:       p.ImageHash,
+		Attachments:     append([]Attachment(nil), p.Attachments...),
+		Campaign:        p.Campaign,
+		LikeCount:       p.LikeCount,
+		AttachmentCount: len(p.Attachments),
+		LikedByViewer:   viewer != "" && p.LikedBy(viewer),
+	}
+
+	app.renderPost(&out)
+	return out
+}
+
+func (app *Config) postsV1(posts []Post, viewer string) []PostV1 {
+	out := make([]PostV1, 0, len(posts))
+	for _, p := range posts {
+		out = append(out, app.postV1(p, viewer))
+	}
+
+	return out
+}
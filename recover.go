@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// When mainCID.json is missing or unreadable the head is rebuilt from what
+// else knows about it: the local journal, our IPNS name and the /getCid of
+// peer instances (HEAD_PEERS). Every candidate is scored by the length of
+// the prev chain behind it that can actually be fetched and decoded, and
+// the longest chain wins; ties go to the earlier source in that order.
+
+const (
+	// journalCandidates is how many of the latest journal heads are
+	// tried, in case the newest one never made it to the network.
+	journalCandidates = 3
+
+	peerTimeout = 10 * time.Second
+)
+
+// errNoHead means no recovery source knows of any head, which is only the
+// case for a new installation.
+var errNoHead = errors.New("no recovery source knows of a head")
+
+type HeadCandidate struct {
+	Source string `json:"source"`
+	CID    string `json:"cid"`
+	Prev   string `json:"prev,omitempty"`
+	Length int    `json:"length"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkHead reports whether mainCID.json holds a usable CID.
+func checkHead() error {
+	cid, err := ReadCIDFromFile()
+	if err != nil {
+		return err
+	}
+
+	_, err = parseCID(cid)
+	return err
+}
+
+// ensureHead makes sure mainCID.json names the head before the database is
+// seeded from it. Starting without it while the feed exists somewhere would
+// publish a feed without its posts and overwrite IPNS and the journal with
+// it, so the only start without a head is a new installation: no journal,
+// no IPNS record and no peers.
+func (app *Config) ensureHead(ctx context.Context) error {
+	err := checkHead()
+	if err == nil {
+		return nil
+	}
+	log.Println("head unavailable, recovering:", err)
+
+	_, err = app.recoverHead(ctx)
+	if errors.Is(err, errNoHead) {
+		log.Println("no head anywhere, starting a new feed")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("head recovery failed: %w", err)
+	}
+
+	return nil
+}
+
+// recoverHead picks the best candidate head and writes it to mainCID.json.
+func (app *Config) recoverHead(ctx context.Context) (*HeadCandidate, error) {
+	candidates := app.headCandidates(ctx)
+	if len(candidates) == 0 {
+		return nil, errNoHead
+	}
+
+	depth := envInt("HEAD_RECOVERY_DEPTH", 1000)
+	lengths := make(map[string]int)
+
+	var best *HeadCandidate
+	for i := range candidates {
+		c := &candidates[i]
+		if c.Error == "" {
+			var err error
+			c.Length, c.Prev, err = app.chainLength(ctx, c.CID, depth, lengths)
+			if err != nil {
+				c.Error = err.Error()
+			}
+		}
+		log.Printf("head candidate from %s: %q, chain of %d %s", c.Source, c.CID, c.Length, c.Error)
+
+		if c.Error == "" && (best == nil || c.Length > best.Length) {
+			best = c
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("no usable head candidate")
+	}
+
+	err := WriteCIDToFile(best.CID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendJournal(best.CID, best.Prev)
+	if err != nil {
+		log.Printf("head %s: could not write journal: %v", best.CID, err)
+	}
+
+	log.Printf("recovered head %s from %s", best.CID, best.Source)
+	return best, nil
+}
+
+// headCandidates asks every recovery source for its head. Sources that fail
+// are listed with the error.
+func (app *Config) headCandidates(ctx context.Context) []HeadCandidate {
+	var candidates []HeadCandidate
+
+	entries, err := readJournal()
+	if err != nil {
+		candidates = append(candidates, HeadCandidate{Source: "journal", Error: err.Error()})
+	}
+	seen := make(map[string]bool)
+	for i := len(entries) - 1; i >= 0 && len(seen) < journalCandidates; i-- {
+		if cid := entries[i].CID; !seen[cid] {
+			seen[cid] = true
+			candidates = append(candidates, HeadCandidate{Source: "journal", CID: cid})
+		}
+	}
+
+	for _, p := range app.Publishers {
+		ipns, ok := p.(*IPNSPublisher)
+		if !ok {
+			continue
+		}
+
+		c := HeadCandidate{Source: "ipns"}
+		c.CID, err = ipns.Resolve(ctx)
+		if errors.Is(err, errNoIPNSRecord) {
+			log.Println("head candidate from ipns: none published")
+			continue
+		}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		candidates = append(candidates, c)
+	}
+
+	for _, peer := range strings.Split(envOr("HEAD_PEERS", ""), ",") {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer == "" {
+			continue
+		}
+
+		c := HeadCandidate{Source: peer}
+		c.CID, err = peerHead(ctx, peer)
+		if err != nil {
+			c.Error = err.Error()
+		}
+		candidates = append(candidates, c)
+	}
+
+	return candidates
+}
+
+// peerHead asks another instance of this server for its head.
+func peerHead(ctx context.Context, peer string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/getCid", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var out struct {
+		Message string  `json:"message"`
+		Data    MainCID `json:"data"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&out)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("peer answered %s: %s", res.Status, out.Message)
+	}
+
+	_, err = parseCID(out.Data.CID)
+	if err != nil {
+		return "", err
+	}
+
+	return out.Data.CID, nil
+}
+
+// chainLength counts the root documents from cid back along prev that can
+// be fetched and decoded, up to depth. Lengths already known from other
+// candidates are reused, so chains that share history are walked once. It
+// also returns the prev of cid itself.
+func (app *Config) chainLength(ctx context.Context, cid string, depth int, known map[string]int) (int, string, error) {
+	var path []string
+	length := 0
+	prevOfHead := ""
+
+	for next := cid; next != "" && len(path) < depth; {
+		if n, ok := known[next]; ok {
+			length = n
+			break
+		}
+
+		data, err := app.fetchFromIPFS(ctx, next)
+		prev := ""
+		if err == nil {
+			_, prev, err = decodeFeed(data)
+		}
+		if err != nil {
+			if len(path) == 0 {
+				return 0, "", err
+			}
+			// The chain is valid up to the document before.
+			break
+		}
+
+		if len(path) == 0 {
+			prevOfHead = prev
+		}
+		path = append(path, next)
+		next = prev
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		length++
+		known[path[i]] = length
+	}
+
+	return length, prevOfHead, nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads let clients on flaky networks send a large file in
+// chunks: create a session, PATCH chunks at the current offset, ask for the
+// offset after a failure, and finalize once every byte has arrived.
+
+const (
+	uploadOffsetHeader = "Upload-Offset"
+	uploadLengthHeader = "Upload-Length"
+
+	uploadSessionTTL = 24 * time.Hour
+)
+
+var (
+	sessionLocks sync.Map
+)
+
+type UploadSession struct {
+	ID          string    `json:"id"`
+	UserAddress string    `json:"user_address"`
+	MediaType   string    `json:"media_type"`
+	Desc        string    `json:"desc"`
+	Campaign    string    `json:"campaign"`
+	FileName    string    `json:"file_name"`
+	Size        int64     `json:"size"`
+	Offset      int64     `json:"offset"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func (app *Config) sessionPath(id, ext string) string {
+	return filepath.Join(app.UploadDir, id+ext)
+}
+
+// lockSession serialises requests for one session. Chunks for different
+// sessions are written concurrently.
+func lockSession(id string) func() {
+	m, _ := sessionLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func validSessionID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (app *Config) readSession(id string) (*UploadSession, error) {
+	if !validSessionID(id) {
+		return nil, errUploadNotFound
+	}
+
+	data, err := os.ReadFile(app.sessionPath(id, ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session UploadSession
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		app.removeSession(id)
+		return nil, errUploadNotFound
+	}
+
+	return &session, nil
+}
+
+func (app *Config) writeSession(session *UploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	tmp := app.sessionPath(session.ID, ".json.tmp")
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, app.sessionPath(session.ID, ".json"))
+}
+
+func (app *Config) removeSession(id string) {
+	os.Remove(app.sessionPath(id, ".json"))
+	os.Remove(app.sessionPath(id, ".part"))
+	sessionLocks.Delete(id)
+}
+
+// removeExpiredSessions deletes sessions that were abandoned.
+func (app *Config) removeExpiredSessions() {
+	matches, _ := filepath.Glob(filepath.Join(app.UploadDir, "*.json"))
+	for _, m := range matches {
+		id := filepath.Base(m[:len(m)-len(".json")])
+		unlock := lockSession(id)
+		app.readSession(id)
+		unlock()
+	}
+}
+
+func setUploadHeaders(w http.ResponseWriter, session *UploadSession) {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+	w.Header().Set(uploadLengthHeader, strconv.FormatInt(session.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func (app *Config) createUploadSession(w http.ResponseWriter, r *http.Request) {
+	var payload UploadSession
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var v ValidationError
+	v.address("user_address", payload.UserAddress)
+	v.required("media_type", payload.MediaType)
+	v.required("file_name", payload.FileName)
+	if payload.Size <= 0 {
+		v.add("size", CodeInvalidRequest, "must be a positive number of bytes")
+	}
+	if err := v.err(); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if len(allowedMIME[payload.MediaType]) == 0 {
+		app.errorJSON(w, checkMIME(payload.MediaType, ""))
+		return
+	}
+
+	if payload.Size > app.uploadLimit(payload.MediaType) {
+		app.errorJSON(w, errMediaTooLarge(app.uploadLimit(payload.MediaType)))
+		return
+	}
+
+	app.removeExpiredSessions()
+
+	err = os.MkdirAll(app.UploadDir, 0o700)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	session := payload
+	session.ID = StringRandom(16)
+	session.Offset = 0
+	session.ExpiresAt = time.Now().Add(uploadSessionTTL)
+
+	part, err := os.OpenFile(app.sessionPath(session.ID, ".part"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	part.Close()
+
+	err = app.writeSession(&session)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setUploadHeaders(w, &session)
+	w.Header().Set("Location", "/uploads/"+session.ID)
+	app.writeJSON(w, http.StatusCreated, jsonResponse{
+		Message: "upload session created",
+		Data:    session,
+	})
+}
+
+func (app *Config) uploadStatus(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !validSessionID(id) {
+		app.errorJSON(w, errUploadNotFound)
+		return
+	}
+
+	unlock := lockSession(id)
+	session, err := app.readSession(id)
+	unlock()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setUploadHeaders(w, session)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "upload progress",
+		Data:    session,
+	})
+}
+
+// patchUpload appends a chunk. The Upload-Offset header must match the
+// offset the server has, so a client that lost a response asks for the
+// offset and resumes from there.
+//
+// The chunk is received into a file of its own without holding the session
+// lock, so a slow or stalled client does not hold up status requests or its
+// own retry. It is appended under the lock, and only if the session is still
+// at the offset it was sent for.
+func (app *Config) patchUpload(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !validSessionID(id) {
+		app.errorJSON(w, errUploadNotFound)
+		return
+	}
+
+	unlock := lockSession(id)
+	session, err := app.readSession(id)
+	unlock()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		app.errorJSON(w, apiError(CodeInvalidRequest, err, "Upload-Offset header is required"))
+		return
+	}
+
+	if offset != session.Offset {
+		setUploadHeaders(w, session)
+		app.errorJSON(w, apiErrorf(CodeOffsetMismatch, "upload is at offset %d, not %d", session.Offset, offset))
+		return
+	}
+
+	chunk, err := os.CreateTemp(app.UploadDir, id+"-*.chunk")
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(chunk.Name())
+	defer chunk.Close()
+
+	remaining := session.Size - offset
+	n, copyErr := io.Copy(chunk, io.LimitReader(r.Body, remaining+1))
+	if n > remaining {
+		app.errorJSON(w, apiErrorf(CodePayloadTooLarge, "chunk goes past the declared size of %d bytes", session.Size))
+		return
+	}
+
+	unlock = lockSession(id)
+	defer unlock()
+
+	session, err = app.readSession(id)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Another request for the same offset got there first.
+	if offset != session.Offset {
+		setUploadHeaders(w, session)
+		app.errorJSON(w, apiErrorf(CodeOffsetMismatch, "upload is at offset %d, not %d", session.Offset, offset))
+		return
+	}
+
+	_, err = chunk.Seek(0, io.SeekStart)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	part, err := os.OpenFile(app.sessionPath(id, ".part"), os.O_WRONLY, 0o600)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer part.Close()
+
+	// Drop anything an append that failed halfway wrote past the offset.
+	err = part.Truncate(session.Offset)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = part.Seek(session.Offset, io.SeekStart)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Keep whatever arrived before the connection dropped; the client
+	// resumes from the new offset.
+	_, err = io.Copy(part, chunk)
+	if err == nil {
+		err = part.Sync()
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	session.Offset += n
+	err = app.writeSession(session)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setUploadHeaders(w, session)
+	if copyErr != nil {
+		app.errorJSON(w, copyErr, http.StatusBadRequest)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "chunk stored",
+		Data:    session,
+	})
+}
+
+// finalizeUpload hands the assembled file to the same IPFS add and post
+// creation as a direct upload.
+func (app *Config) finalizeUpload(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !validSessionID(id) {
+		app.errorJSON(w, errUploadNotFound)
+		return
+	}
+
+	unlock := lockSession(id)
+	defer unlock()
+
+	session, err := app.readSession(id)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if session.Offset != session.Size {
+		setUploadHeaders(w, session)
+		app.errorJSON(w, apiErrorf(CodeUploadIncomplete, "received %d of %d bytes", session.Offset, session.Size))
+		return
+	}
+
+	file, err := os.Open(app.sessionPath(id, ".part"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	media, err := app.storeMedia(r.Context(), file, session.FileName, session.MediaType)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	defer media.Close()
+
+	post, err := app.createPost(r.Context(), session.UserAddress, session.MediaType, session.Desc, session.Campaign, media)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.removeSession(id)
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "post created",
+		Data: map[string]interface{}{
+			"id":             post.Id,
+			"published_head": post.Head,
+			"post":           app.postV1(post.Post, session.UserAddress),
+		},
+	})
+}
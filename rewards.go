@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/diamcircle/go/amount"
+	"github.com/diamcircle/go/clients/auroraclient"
+	"github.com/diamcircle/go/keypair"
+	hProtocol "github.com/diamcircle/go/protocols/aurora"
+	"github.com/diamcircle/go/txnbuild"
+)
+
+const defaultCampaignID = "default"
+
+// Campaign describes which asset a post is rewarded and tipped in, how much
+// the reward pays out and how many likes it takes to trigger it.
+type Campaign struct {
+	ID            string `json:"id"`
+	AssetCode     string `json:"asset_code"`
+	AssetIssuer   string `json:"asset_issuer"`
+	RewardAmount  string `json:"reward_amount"`
+	LikeThreshold int    `json:"like_threshold"`
+}
+
+var defaultCampaign = Campaign{
+	ID:            defaultCampaignID,
+	RewardAmount:  "50",
+	LikeThreshold: 99,
+}
+
+func (c Campaign) isNative() bool {
+	return c.AssetCode == "" || c.AssetCode == "native"
+}
+
+func (c Campaign) asset() txnbuild.Asset {
+	if c.isNative() {
+		return txnbuild.NativeAsset{}
+	}
+
+	return txnbuild.CreditAsset{Code: c.AssetCode, Issuer: c.AssetIssuer}
+}
+
+func (c Campaign) assetName() string {
+	if c.isNative() {
+		return "native"
+	}
+
+	return c.AssetCode + ":" + c.AssetIssuer
+}
+
+func (c Campaign) validate() error {
+	if c.ID == "" {
+		return errors.New("campaign id is required")
+	}
+
+	if !c.isNative() {
+		if len(c.AssetCode) > 12 {
+			return fmt.Errorf("campaign %s: asset code %q is too long", c.ID, c.AssetCode)
+		}
+		if _, err := keypair.ParseAddress(c.AssetIssuer); err != nil {
+			return fmt.Errorf("campaign %s: invalid asset issuer", c.ID)
+		}
+	}
+
+	if _, err := amount.ParseInt64(c.RewardAmount); err != nil {
+		return fmt.Errorf("campaign %s: invalid reward amount %q", c.ID, c.RewardAmount)
+	}
+
+	return nil
+}
+
+// ReadCampaignsFromFile loads the campaign list. The built-in default
+// campaign (native asset, 50 per 99 likes) is used when the file is missing
+// or does not override it.
+func ReadCampaignsFromFile() (map[string]Campaign, error) {
+	campaigns := map[string]Campaign{defaultCampaignID: defaultCampaign}
+
+	data, err := os.ReadFile(envOr("CAMPAIGNS_FILE", "campaigns.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return campaigns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Campaign
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range list {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		campaigns[c.ID] = c
+	}
+
+	return campaigns, nil
+}
+
+func getCampaign(id string) (Campaign, error) {
+	if id == "" {
+		id = defaultCampaignID
+	}
+
+	campaigns, err := ReadCampaignsFromFile()
+	if err != nil {
+		return Campaign{}, err
+	}
+
+	c, ok := campaigns[id]
+	if !ok {
+		return Campaign{}, apiErrorf(CodeUnknownCampaign, "unknown campaign %q", id)
+	}
+
+	return c, nil
+}
+
+// hasTrustline reports whether the account can hold the campaign asset.
+// Every account can hold the native asset.
+func hasTrustline(account hProtocol.Account, c Campaign) bool {
+	if c.isNative() {
+		return true
+	}
+
+	for _, b := range account.Balances {
+		if b.Code == c.AssetCode && b.Issuer == c.AssetIssuer {
+			return true
+		}
+	}
+
+	return false
+}
+
+func errNoTrustline(address string, c Campaign) error {
+	return apiErrorf(CodeNoTrustline, "recipient %s has no trustline for %s", address, c.assetName())
+}
+
+// Rewards are paid in the background. The like that brings a post to its
+// campaign's threshold queues the reward (see DB.LikePost), and runRewards
+// pays it, retrying with backoff while the chain is unavailable or the
+// author cannot receive it yet, e.g. for lack of a trustline. Likers never
+// wait for, or see errors from, the payment.
+//
+// A reward is paid once its ledger record is confirmed. A transaction whose
+// submission failed without a verdict may still land, so another one is
+// only built once the first is known to have failed or expired unseen.
+
+const (
+	rewardDue  = "due"
+	rewardPaid = "paid"
+
+	rewardBaseBackoff = time.Minute
+	rewardMaxBackoff  = 6 * time.Hour
+	rewardPollEvery   = time.Minute
+
+	// rewardTxTimeout bounds how long a reward transaction can take to
+	// make it into a ledger.
+	rewardTxTimeout = 5 * time.Minute
+)
+
+var rewardWake = make(chan struct{}, 1)
+
+// Reward is the campaign reward of a post that reached its like threshold.
+type Reward struct {
+	PostID      string    `json:"post_id"`
+	Status      string    `json:"status"`
+	TxHash      string    `json:"tx_hash,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func wakeRewards() {
+	select {
+	case rewardWake <- struct{}{}:
+	default:
+	}
+}
+
+// runRewards pays due rewards until ctx is cancelled.
+func (app *Config) runRewards(ctx context.Context) {
+	ticker := time.NewTicker(rewardPollEvery)
+	defer ticker.Stop()
+
+	for {
+		app.processRewards()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-rewardWake:
+		}
+	}
+}
+
+func (app *Config) processRewards() {
+	rewards, err := app.DB.Rewards()
+	if err != nil {
+		log.Println("rewards:", err)
+		return
+	}
+
+	now := time.Now()
+	for _, r := range rewards {
+		if r.Status != rewardDue || r.NextAttempt.After(now) {
+			continue
+		}
+
+		txHash, err := app.sendReward(r.PostID)
+		r.UpdatedAt = time.Now()
+		if err == nil {
+			r.Status, r.TxHash, r.LastError = rewardPaid, txHash, ""
+		} else {
+			r.Attempts++
+			r.LastError = err.Error()
+			log.Printf("reward for post %s failed %d times: %v", r.PostID, r.Attempts, err)
+
+			backoff := rewardBaseBackoff << (r.Attempts - 1)
+			if backoff > rewardMaxBackoff || backoff <= 0 {
+				backoff = rewardMaxBackoff
+			}
+			r.NextAttempt = r.UpdatedAt.Add(backoff)
+		}
+
+		err = app.DB.PutReward(r)
+		if err != nil {
+			log.Println("rewards:", err)
+		}
+	}
+}
+
+// sendReward pays the reward of a post, unless the payments ledger shows one
+// was sent already, and returns the hash of the confirmed transaction. While
+// an earlier transaction may still land it returns an error instead.
+func (app *Config) sendReward(postID string) (string, error) {
+	rec, err := rewardPayment(postID)
+	if err != nil {
+		return "", err
+	}
+	if rec != nil && rec.Status == paymentConfirmed {
+		return rec.TxHash, nil
+	}
+	if rec != nil {
+		tx, err := app.Aurora.TransactionDetail(rec.TxHash)
+		switch {
+		case err == nil && tx.Successful:
+			err = setPaymentStatus(rec.TxHash, paymentConfirmed, "")
+			if err != nil {
+				return "", err
+			}
+			return rec.TxHash, nil
+		case err == nil:
+			err = setPaymentStatus(rec.TxHash, paymentFailed, "transaction failed on chain")
+		case auroraclient.IsNotFoundError(err) && rec.expired(time.Now()):
+			err = setPaymentStatus(rec.TxHash, paymentFailed, "transaction expired before reaching the chain")
+		case auroraclient.IsNotFoundError(err):
+			return "", fmt.Errorf("reward transaction %s is not in a ledger yet", rec.TxHash)
+		default:
+			return "", apiError(CodeChainUnavailable, err)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	post, err := app.DB.Post(postID)
+	if err != nil {
+		return "", err
+	}
+
+	campaign, err := getCampaign(post.Campaign)
+	if err != nil {
+		return "", err
+	}
+
+	return app.payReward(*post, campaign)
+}
+
+func (app *Config) listRewards(w http.ResponseWriter, r *http.Request) {
+	rewards, err := app.DB.Rewards()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "rewards",
+		Data:    rewards,
+	})
+}
+
+// payReward sends the campaign reward from the reward account to the post
+// author and returns the transaction hash.
+func (app *Config) payReward(post Post, c Campaign) (string, error) {
+	sourceKP, err := keypair.ParseFull(app.RewardSeed)
+	if err != nil {
+		return "", errors.New("reward account is not configured")
+	}
+
+	// An address that was never funded cannot receive a payment, so the
+	// reward creates the account with the starting balance instead.
+	method := paymentMethodPayment
+	op := txnbuild.Operation(&txnbuild.Payment{
+		Destination: post.UserAddress,
+		Amount:      c.RewardAmount,
+		Asset:       c.asset(),
+	})
+	asset, amt := c.assetName(), c.RewardAmount
+
+	recipient, err := app.Aurora.AccountDetail(auroraclient.AccountRequest{AccountID: post.UserAddress})
+	switch {
+	case auroraclient.IsNotFoundError(err):
+		method = paymentMethodCreateAccount
+		op = &txnbuild.CreateAccount{
+			Destination: post.UserAddress,
+			Amount:      app.StartingBalance,
+		}
+		asset, amt = "native", app.StartingBalance
+	case err != nil:
+		return "", apiError(CodeChainUnavailable, err)
+	case !hasTrustline(recipient, c):
+		return "", errNoTrustline(post.UserAddress, c)
+	}
+
+	sourceAccount, err := app.Aurora.AccountDetail(auroraclient.AccountRequest{AccountID: sourceKP.Address()})
+	if err != nil {
+		return "", apiError(CodeChainUnavailable, err)
+	}
+
+	memo, memoText := paymentMemo(paymentKindReward, post.Id)
+
+	tx, err := txnbuild.NewTransaction(
+		txnbuild.TransactionParams{
+			SourceAccount:        &sourceAccount,
+			IncrementSequenceNum: true,
+			BaseFee:              txnbuild.MinBaseFee,
+			Timebounds:           txnbuild.NewTimeout(int64(rewardTxTimeout.Seconds())),
+			Memo:                 memo,
+			Operations:           []txnbuild.Operation{op},
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err = tx.Sign(app.NetworkPassphrase, sourceKP)
+	if err != nil {
+		return "", err
+	}
+
+	txHash, err := tx.HashHex(app.NetworkPassphrase)
+	if err != nil {
+		return "", err
+	}
+
+	err = recordPayment(PaymentRecord{
+		TxHash:     txHash,
+		PostID:     post.Id,
+		Kind:       paymentKindReward,
+		Method:     method,
+		Memo:       memoText,
+		From:       sourceKP.Address(),
+		To:         post.UserAddress,
+		Asset:      asset,
+		Amount:     amt,
+		ValidUntil: time.Unix(tx.Timebounds().MaxTime, 0),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	_, err = app.Aurora.SubmitTransaction(tx)
+	if submitRejected(err) {
+		setPaymentStatus(txHash, paymentFailed, err.Error())
+		return "", err
+	}
+	if err != nil {
+		// The transaction may still land, e.g. after a timeout; it stays
+		// pending for the next attempt to look up.
+		return "", apiError(CodeChainUnavailable, err)
+	}
+
+	err = setPaymentStatus(txHash, paymentConfirmed, "")
+	if err != nil {
+		return "", err
+	}
+
+	return txHash, nil
+}
+
+// submitRejected reports whether a submission error means the network
+// refused the transaction, so it can never be applied. Other errors, such
+// as a timeout, leave it open whether it will land.
+func submitRejected(err error) bool {
+	herr := auroraclient.GetError(err)
+	if herr == nil {
+		return false
+	}
+
+	_, err = herr.ResultCodes()
+	return err == nil
+}
+
+// tip builds an unsigned payment from the tipper to the author of a post in
+// the post's campaign asset. The client signs and submits it.
+func (app *Config) tip(w http.ResponseWriter, r *http.Request) {
+	type tipP struct {
+		From   string `json:"from_address"`
+		Id     string `json:"id"`
+		Amount string `json:"amount"`
+	}
+	var payload tipP
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var v ValidationError
+	v.address("from_address", payload.From)
+	v.required("id", payload.Id)
+	v.amount("amount", payload.Amount)
+	if err := v.err(); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	post, err := app.DB.Post(payload.Id)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	c, err := getCampaign(post.Campaign)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	recipient, err := app.Aurora.AccountDetail(auroraclient.AccountRequest{AccountID: post.UserAddress})
+	if auroraclient.IsNotFoundError(err) {
+		app.errorJSON(w, apiErrorf(CodeAccountNotFunded, "recipient %s has not been funded yet", post.UserAddress))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, apiError(CodeChainUnavailable, err))
+		return
+	}
+
+	if !hasTrustline(recipient, c) {
+		app.errorJSON(w, errNoTrustline(post.UserAddress, c))
+		return
+	}
+
+	sourceAccount, err := app.Aurora.AccountDetail(auroraclient.AccountRequest{AccountID: payload.From})
+	if auroraclient.IsNotFoundError(err) {
+		app.errorJSON(w, apiErrorf(CodeAccountNotFunded, "tipper %s has not been funded yet", payload.From))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, apiError(CodeChainUnavailable, err))
+		return
+	}
+
+	memo, memoText := paymentMemo(paymentKindTip, post.Id)
+
+	tx, err := txnbuild.NewTransaction(
+		txnbuild.TransactionParams{
+			SourceAccount:        &sourceAccount,
+			IncrementSequenceNum: true,
+			BaseFee:              txnbuild.MinBaseFee,
+			Timebounds:           txnbuild.NewTimeout(300),
+			Memo:                 memo,
+			Operations: []txnbuild.Operation{
+				&txnbuild.Payment{
+					Destination: post.UserAddress,
+					Amount:      payload.Amount,
+					Asset:       c.asset(),
+				},
+			},
+		},
+	)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	envelope, err := tx.Base64()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	txHash, err := tx.HashHex(app.NetworkPassphrase)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = recordPayment(PaymentRecord{
+		TxHash:     txHash,
+		PostID:     post.Id,
+		Kind:       paymentKindTip,
+		Method:     paymentMethodPayment,
+		Memo:       memoText,
+		From:       payload.From,
+		To:         post.UserAddress,
+		Asset:      c.assetName(),
+		Amount:     payload.Amount,
+		ValidUntil: time.Unix(tx.Timebounds().MaxTime, 0),
+	})
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "sign and submit the envelope to send the tip",
+		Data: map[string]interface{}{
+			"asset":    c.assetName(),
+			"envelope": envelope,
+			"tx_hash":  txHash,
+		},
+	})
+}
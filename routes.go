@@ -13,27 +13,55 @@ func (app *Config) routes() http.Handler {
 
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", uploadOffsetHeader},
+		ExposedHeaders:   []string{"Link", "Location", requestIDHeader, uploadOffsetHeader, uploadLengthHeader},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	mux.Use(middleware.Heartbeat("/ping"))
+	mux.Use(middleware.RequestID)
+	mux.Use(requestID)
 
 	mux.Post("/check", app.Check)
 
 	mux.Post("/upload", app.Upload)
 
+	mux.Post("/uploads", app.createUploadSession)
+	mux.Head("/uploads/{id}", app.uploadStatus)
+	mux.Get("/uploads/{id}", app.uploadStatus)
+	mux.Patch("/uploads/{id}", app.patchUpload)
+	mux.Post("/uploads/{id}/finalize", app.finalizeUpload)
+
 	mux.Post("/metadata", app.getMetaData)
 
 	mux.Post("/getCid", app.getCIDFromFile)
 	mux.Post("/add-likes-to-posts", app.addLikesToPosts)
 
+	mux.Post("/tip", app.tip)
+
+	mux.Post("/post-earnings", app.getPostEarnings)
+
 	mux.Post("/get-post-from-id", app.getPostFromId)
 
 	mux.Post("/get-post-from-address", app.getPostFromAddress)
 
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.requireAdmin)
+
+		mux.Get("/mirror-jobs", app.listMirrorJobs)
+		mux.Post("/mirror-jobs/{id}/replay", app.replayMirrorJob)
+
+		mux.Get("/gateways", app.gatewayHealth)
+
+		mux.Get("/pins", app.listPins)
+		mux.Post("/pins/reconcile", app.reconcilePinsNow)
+
+		mux.Get("/head", app.headStatus)
+
+		mux.Get("/rewards", app.listRewards)
+	})
+
 	return mux
 }
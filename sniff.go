@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// Post media types as sent in the media_type form field.
+const (
+	mediaTypeText  = "1"
+	mediaTypeImage = "2"
+	mediaTypeVideo = "3"
+)
+
+// sniffLen is how many leading bytes are inspected. It matches what
+// http.DetectContentType looks at.
+const sniffLen = 512
+
+// allowedMIME lists the detected content types each media type accepts.
+// Text posts carry no file. HEIF is not accepted for images because its
+// EXIF cannot be stripped without a decoder.
+var allowedMIME = map[string][]string{
+	mediaTypeText: {},
+	mediaTypeImage: {
+		"image/jpeg",
+		"image/png",
+		"image/gif",
+		"image/webp",
+	},
+	mediaTypeVideo: {
+		"video/mp4",
+		"video/webm",
+		"video/quicktime",
+		"video/3gpp",
+	},
+}
+
+// sniffMIME detects the content type from the leading bytes of a file. It
+// never trusts the file name or the client's Content-Type.
+func sniffMIME(head []byte) string {
+	if ct := sniffFtyp(head); ct != "" {
+		return ct
+	}
+
+	ct := http.DetectContentType(head)
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+
+	return ct
+}
+
+// sniffFtyp recognises ISO base media files that http.DetectContentType
+// does not tell apart: HEIF images, QuickTime and 3GP video.
+func sniffFtyp(head []byte) string {
+	if len(head) < 12 || !bytes.Equal(head[4:8], []byte("ftyp")) {
+		return ""
+	}
+
+	switch string(head[8:12]) {
+	case "heic", "heix", "heim", "heis":
+		return "image/heic"
+	case "mif1", "msf1", "heif":
+		return "image/heif"
+	case "qt  ":
+		return "video/quicktime"
+	case "3gp4", "3gp5", "3gp6", "3g2a":
+		return "video/3gpp"
+	}
+
+	return ""
+}
+
+// checkMIME rejects content that is not allowed for the media type.
+func checkMIME(mediaType, mime string) error {
+	allowed, ok := allowedMIME[mediaType]
+	if !ok {
+		var v ValidationError
+		v.add("media_type", CodeInvalidRequest, "must be 1, 2 or 3")
+		return v.err()
+	}
+
+	for _, a := range allowed {
+		if a == mime {
+			return nil
+		}
+	}
+
+	if len(allowed) == 0 {
+		return apiErrorf(CodeUnsupportedMedia, "media_type %s does not take a file", mediaType)
+	}
+
+	return apiErrorf(CodeUnsupportedMedia, "media_type %s does not accept %s, expected one of %s", mediaType, mime, strings.Join(allowed, ", "))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MirrorService receives a copy of every uploaded file. The storage service
+// at STORAGE_URL is the production implementation; anything speaking the
+// same two endpoints, such as an httptest server, can stand in for it.
+type MirrorService interface {
+	Upload(ctx context.Context, uid string, file io.ReadSeeker, fileName string) error
+}
+
+const (
+	// tokenRefreshMargin renews the token this long before it expires so
+	// a request never starts with a token about to lapse.
+	tokenRefreshMargin = time.Minute
+)
+
+var errStorageUnauthorized = errors.New("storage service rejected the token")
+
+// StorageClient talks to the storage service. It logs in once, reuses the
+// bearer token until shortly before it expires and logs in again when the
+// service answers 401.
+type StorageClient struct {
+	BaseURL  string
+	UserName string
+	MPIN     string
+	// TokenTTL is assumed for tokens that do not carry an expiry.
+	TokenTTL time.Duration
+	HTTP     *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func NewStorageClient(baseURL, userName, mpin string) *StorageClient {
+	return &StorageClient{
+		BaseURL:  strings.TrimRight(baseURL, "/"),
+		UserName: userName,
+		MPIN:     mpin,
+		TokenTTL: 15 * time.Minute,
+		HTTP: &http.Client{
+			// Uploads can be large; the transport timeouts catch a dead
+			// service without cutting off a slow but healthy upload.
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost:   4,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 2 * time.Minute,
+			},
+			Timeout: 30 * time.Minute,
+		},
+	}
+}
+
+// Token returns a valid bearer token, logging in when there is none or the
+// cached one is about to expire.
+func (c *StorageClient) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Add(tokenRefreshMargin).Before(c.expires) {
+		return c.token, nil
+	}
+
+	token, err := c.login(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	c.token = token
+	c.expires = tokenExpiry(token, time.Now().Add(c.TokenTTL))
+
+	return token, nil
+}
+
+// invalidate drops token if it is still the cached one.
+func (c *StorageClient) invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+func (c *StorageClient) login(ctx context.Context) (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"userName": c.UserName,
+		"mpin":     c.MPIN,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/v1/login", strings.NewReader(string(payload)))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("Accept", "*/*")
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("storage login answered %s: %s", res.Status, body)
+	}
+
+	var response map[string]interface{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return "", err
+	}
+
+	token, ok := response["token"].(string)
+	if !ok {
+		return "", errors.New("invalid token response")
+	}
+
+	return token, nil
+}
+
+// tokenExpiry reads the exp claim when the token is a JWT, or returns def.
+func tokenExpiry(token string, def time.Time) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return def
+	}
+
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return def
+	}
+
+	var payload struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(claims, &payload) != nil || payload.Exp == 0 {
+		return def
+	}
+
+	return time.Unix(payload.Exp, 0)
+}
+
+// Upload sends file to the service, logging in again and retrying once if
+// the cached token was rejected.
+func (c *StorageClient) Upload(ctx context.Context, uid string, file io.ReadSeeker, fileName string) error {
+	token, err := c.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = c.upload(ctx, token, uid, file, fileName)
+	if !errors.Is(err, errStorageUnauthorized) {
+		return err
+	}
+
+	c.invalidate(token)
+	token, err = c.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return c.upload(ctx, token, uid, file, fileName)
+}
+
+func (c *StorageClient) upload(ctx context.Context, token, uid string, file io.Reader, fileName string) error {
+	// Stream the multipart body instead of assembling it in memory.
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	done := make(chan struct{})
+	// The transport may give up on the body while the writer is still
+	// copying from file, e.g. when the service answers before reading it.
+	// Upload rewinds file for a retry, so the writer must be gone first.
+	defer func() {
+		pr.Close()
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		_ = writer.WriteField("uid", uid)
+		part, err := writer.CreateFormFile("files", fileName)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(part, file)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/v1/upload-data", pr)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Accept", "*/*")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return errStorageUnauthorized
+	}
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("storage service answered %s: %s", res.Status, body)
+	}
+
+	return nil
+}
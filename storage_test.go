@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStorage stands in for the storage service. It hands out the tokens
+// in order and rejects uploads with any token but the last one issued.
+type fakeStorage struct {
+	t      *testing.T
+	tokens []string
+
+	mu      sync.Mutex
+	logins  int
+	valid   string
+	uploads [][]byte
+}
+
+func (f *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/v1/login":
+		token := f.tokens[f.logins]
+		f.logins++
+		f.valid = token
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+
+	case "/v1/upload-data":
+		if f.valid == "" || r.Header.Get("Authorization") != "Bearer "+f.valid {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		file, _, err := r.FormFile("files")
+		if err != nil {
+			f.t.Errorf("reading upload: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		f.uploads = append(f.uploads, data)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// watchedFile is a slow file that reports reads overlapping each other or a
+// seek, which is what two upload attempts sharing it look like.
+type watchedFile struct {
+	r *bytes.Reader
+
+	mu      sync.Mutex
+	reading int
+	overlap bool
+}
+
+func (f *watchedFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	f.reading++
+	f.overlap = f.overlap || f.reading > 1
+	f.mu.Unlock()
+
+	time.Sleep(100 * time.Microsecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reading--
+	return f.r.Read(p)
+}
+
+func (f *watchedFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overlap = f.overlap || f.reading > 0
+	return f.r.Seek(offset, whence)
+}
+
+// earlyRejecter answers uploads without the valid token with 401 while it
+// is still sending their body, as a transport does when the service
+// answers before reading it.
+type earlyRejecter struct {
+	fake *fakeStorage
+	next http.RoundTripper
+}
+
+func (e earlyRejecter) RoundTrip(req *http.Request) (*http.Response, error) {
+	e.fake.mu.Lock()
+	valid := e.fake.valid
+	e.fake.mu.Unlock()
+
+	if req.URL.Path != "/v1/upload-data" || req.Header.Get("Authorization") == "Bearer "+valid {
+		return e.next.RoundTrip(req)
+	}
+
+	go func() {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}()
+
+	return &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Status:     "401 Unauthorized",
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func jwtExpiring(t time.Time) string {
+	claims, _ := json.Marshal(map[string]int64{"exp": t.Unix()})
+	return "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+func newTestStorage(t *testing.T, fake *fakeStorage) *StorageClient {
+	fake.t = t
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	c := NewStorageClient(srv.URL, "user", "mpin")
+	c.HTTP = srv.Client()
+	return c
+}
+
+func TestStorageClientCachesToken(t *testing.T) {
+	fake := &fakeStorage{tokens: []string{"a"}}
+	c := newTestStorage(t, fake)
+
+	for i := 0; i < 3; i++ {
+		err := c.Upload(context.Background(), "uid", bytes.NewReader([]byte("file")), "f.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fake.logins != 1 || len(fake.uploads) != 3 {
+		t.Errorf("got %d logins and %d uploads, want 1 and 3", fake.logins, len(fake.uploads))
+	}
+}
+
+func TestStorageClientRefreshesExpiringToken(t *testing.T) {
+	fake := &fakeStorage{tokens: []string{
+		jwtExpiring(time.Now().Add(tokenRefreshMargin / 2)),
+		jwtExpiring(time.Now().Add(time.Hour)),
+	}}
+	c := newTestStorage(t, fake)
+
+	for i := 0; i < 2; i++ {
+		err := c.Upload(context.Background(), "uid", bytes.NewReader([]byte("file")), "f.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first token is already inside the refresh margin when it is
+	// issued, so every Token call logs in until the second one.
+	if fake.logins != 2 {
+		t.Errorf("got %d logins, want 2", fake.logins)
+	}
+}
+
+func TestStorageClientRetriesRejectedToken(t *testing.T) {
+	fake := &fakeStorage{tokens: []string{"a", "b"}}
+	c := newTestStorage(t, fake)
+	c.HTTP = &http.Client{Transport: earlyRejecter{fake: fake, next: c.HTTP.Transport}}
+
+	// Log in, then have the service forget the token.
+	_, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.valid = ""
+	fake.mu.Unlock()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	file := &watchedFile{r: bytes.NewReader(data)}
+	err = c.Upload(context.Background(), "uid", file, "f.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.overlap {
+		t.Error("the first attempt was still reading the file during the retry")
+	}
+	if fake.logins != 2 || len(fake.uploads) != 1 || !bytes.Equal(fake.uploads[0], data) {
+		t.Fatalf("got %d logins and %d uploads; want the file uploaded after a second login", fake.logins, len(fake.uploads))
+	}
+}
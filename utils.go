@@ -1,29 +1,123 @@
-package main
-
-import (
-	"math/rand"
-	"time"
-)
-
-const webPort = "8082"
-
-type Config struct {
-	IPFSNode string
-}
-
-const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-func StringWithCharset(length int, charset string) string {
-	b := make([]byte, length)
-	rand.Seed(time.Now().UnixNano())
-
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
-	}
-
-	return string(b)
-}
-
-func StringRandom(length int) string {
-	return StringWithCharset(length, charset)
-}
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/diamcircle/go/clients/auroraclient"
+)
+
+const webPort = "8082"
+
+type Config struct {
+	IPFSNode          string
+	RewardSeed        string
+	StartingBalance   string
+	NetworkPassphrase string
+	Aurora            *auroraclient.Client
+	MaxUploadBytes    int64
+	MaxVideoBytes     int64
+	UploadDir         string
+	MaxAttachments    int
+	Gateways          []string
+	AdminToken        string
+	Mirror            MirrorService
+	Store             BlobStore
+	MirrorTargets     []string
+	MirrorStores      map[string]BlobStore
+	Pinners           []Pinner
+	Publishers        []HeadPublisher
+	Reader            *GatewayClient
+	DB                *DB
+}
+
+// envOr returns the environment variable key, or def when it is unset.
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+
+	return def
+}
+
+// envBytes reads a size in bytes from the environment, or def when it is
+// unset or not a positive number.
+func envBytes(key string, def int64) int64 {
+	n, err := strconv.ParseInt(envOr(key, ""), 10, 64)
+	if err != nil || n <= 0 {
+		return def
+	}
+
+	return n
+}
+
+// envInt reads a count from the environment, or def when it is unset or
+// not a positive number.
+func envInt(key string, def int) int {
+	n, err := strconv.Atoi(envOr(key, ""))
+	if err != nil || n <= 0 {
+		return def
+	}
+
+	return n
+}
+
+// envDuration reads a duration such as "90m" from the environment, or def
+// when it is unset or not a positive duration.
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(envOr(key, ""))
+	if err != nil || d <= 0 {
+		return def
+	}
+
+	return d
+}
+
+// writeJSONFile replaces name with v as indented JSON. It writes a temporary
+// file next to it and renames it into place, so a crash never leaves name
+// truncated.
+func writeJSONFile(name string, v interface{}) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	encoder := json.NewEncoder(tmp)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(v)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func StringWithCharset(length int, charset string) string {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
+
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = charset[n.Int64()]
+	}
+
+	return string(b)
+}
+
+func StringRandom(length int) string {
+	return StringWithCharset(length, charset)
+}
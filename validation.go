@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/diamcircle/go/amount"
+	"github.com/diamcircle/go/strkey"
+)
+
+// FieldError names a request field and what is wrong with it.
+type FieldError struct {
+	Field   string    `json:"field"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// ValidationError collects every invalid field of a request so the client
+// can fix them in one go. errorJSON reports the fields individually.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (v *ValidationError) Error() string {
+	msgs := make([]string, 0, len(v.Fields))
+	for _, f := range v.Fields {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+func (v *ValidationError) add(field string, code ErrorCode, message string) {
+	v.Fields = append(v.Fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+// code is the code shared by every field error, or INVALID_REQUEST when
+// they differ.
+func (v *ValidationError) code() ErrorCode {
+	code := CodeInvalidRequest
+	for i, f := range v.Fields {
+		if i > 0 && f.Code != code {
+			return CodeInvalidRequest
+		}
+		code = f.Code
+	}
+
+	return code
+}
+
+// required checks that value is not empty.
+func (v *ValidationError) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, CodeInvalidRequest, "is required")
+	}
+}
+
+// address checks that value is a Diamante account address with a valid
+// strkey version byte and checksum.
+func (v *ValidationError) address(field, value string) {
+	if value == "" {
+		v.add(field, CodeInvalidRequest, "is required")
+		return
+	}
+
+	if _, err := strkey.Decode(strkey.VersionByteAccountID, value); err != nil {
+		v.add(field, CodeInvalidAddress, "must be a valid Diamante account address")
+	}
+}
+
+// optionalAddress checks value like address when it is set.
+func (v *ValidationError) optionalAddress(field, value string) {
+	if value != "" {
+		v.address(field, value)
+	}
+}
+
+// amount checks that value is a positive amount with at most 7 decimals.
+func (v *ValidationError) amount(field, value string) {
+	n, err := amount.ParseInt64(value)
+	if err != nil || n <= 0 {
+		v.add(field, CodeInvalidRequest, "must be a positive amount")
+	}
+}
+
+// err returns the collected errors, or nil when every field was valid.
+func (v *ValidationError) err() error {
+	if len(v.Fields) == 0 {
+		return nil
+	}
+
+	return v
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Video uploads are checked by walking their container structure, which
+// also yields the duration, frame size and codec. Neither format can be
+// decoded in pure Go, so the poster is the cover art embedded in the file
+// when there is one (MP4 "covr", Matroska attachments).
+
+const maxPosterBytes = 10 << 20
+
+type videoMeta struct {
+	Duration float64
+	Width    int
+	Height   int
+	Codec    string
+	Poster   []byte
+}
+
+var errUnsupportedContainer = errors.New("unsupported or malformed video container")
+
+// probeVideo parses the container of a video file of the given size.
+func probeVideo(r io.ReaderAt, size int64, mime string) (*videoMeta, error) {
+	var meta *videoMeta
+	var err error
+
+	switch mime {
+	case "video/mp4", "video/quicktime", "video/3gpp":
+		meta, err = probeMP4(r, size)
+	case "video/webm":
+		meta, err = probeWebM(r, size)
+	default:
+		err = errUnsupportedContainer
+	}
+	if err != nil {
+		return nil, apiError(CodeUnsupportedMedia, err, fmt.Sprintf("%s: %v", mime, errUnsupportedContainer))
+	}
+
+	if meta.Width == 0 || meta.Height == 0 {
+		return nil, apiErrorf(CodeUnsupportedMedia, "%s has no video track", mime)
+	}
+
+	return meta, nil
+}
+
+// ISO base media (MP4, QuickTime, 3GP)
+
+type mp4Box struct {
+	typ   string
+	start int64 // payload start
+	end   int64
+}
+
+// mp4Boxes lists the boxes between start and end.
+func mp4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	var hdr [16]byte
+
+	for off := start; off+8 <= end; {
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return nil, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:8])
+		payload := off + 8
+
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			payload += 8
+		}
+
+		if size < payload-off || size > end-off {
+			return nil, errUnsupportedContainer
+		}
+
+		boxes = append(boxes, mp4Box{typ: typ, start: payload, end: off + size})
+		off += size
+	}
+
+	return boxes, nil
+}
+
+func findBox(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+
+	return mp4Box{}, false
+}
+
+// childBoxes descends through a path of box types, returning the children
+// of the last one.
+func childBoxes(r io.ReaderAt, parent mp4Box, path ...string) ([]mp4Box, error) {
+	boxes, err := mp4Boxes(r, parent.start, parent.end)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, typ := range path {
+		b, ok := findBox(boxes, typ)
+		if !ok {
+			return nil, nil
+		}
+		boxes, err = mp4Boxes(r, b.start, b.end)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return boxes, nil
+}
+
+func readBox(r io.ReaderAt, b mp4Box, max int64) ([]byte, error) {
+	n := b.end - b.start
+	if n < 0 {
+		return nil, errUnsupportedContainer
+	}
+	if n > max {
+		n = max
+	}
+
+	buf := make([]byte, n)
+	_, err := r.ReadAt(buf, b.start)
+	return buf, err
+}
+
+var mp4Codecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"av01": "av1",
+	"vp09": "vp9",
+	"mp4v": "mpeg4",
+	"s263": "h263",
+}
+
+func probeMP4(r io.ReaderAt, size int64) (*videoMeta, error) {
+	top, err := mp4Boxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := findBox(top, "ftyp"); !ok {
+		return nil, errUnsupportedContainer
+	}
+
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return nil, errUnsupportedContainer
+	}
+
+	boxes, err := mp4Boxes(r, moov.start, moov.end)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &videoMeta{}
+
+	if mvhd, ok := findBox(boxes, "mvhd"); ok {
+		b, err := readBox(r, mvhd, 32)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) >= 20 && b[0] == 0 {
+			scale, dur := binary.BigEndian.Uint32(b[12:]), binary.BigEndian.Uint32(b[16:])
+			if scale > 0 {
+				meta.Duration = float64(dur) / float64(scale)
+			}
+		} else if len(b) >= 32 && b[0] == 1 {
+			scale, dur := binary.BigEndian.Uint32(b[20:]), binary.BigEndian.Uint64(b[24:])
+			if scale > 0 {
+				meta.Duration = float64(dur) / float64(scale)
+			}
+		}
+	}
+
+	for _, trak := range boxes {
+		if trak.typ != "trak" {
+			continue
+		}
+
+		mdia, err := childBoxes(r, trak, "mdia")
+		if err != nil {
+			return nil, err
+		}
+
+		hdlr, ok := findBox(mdia, "hdlr")
+		if !ok {
+			continue
+		}
+		h, err := readBox(r, hdlr, 12)
+		if err != nil || len(h) < 12 || string(h[8:12]) != "vide" {
+			continue
+		}
+
+		track, err := childBoxes(r, trak)
+		if err != nil {
+			return nil, err
+		}
+
+		if tkhd, ok := findBox(track, "tkhd"); ok {
+			b, err := readBox(r, tkhd, 92)
+			if err != nil {
+				return nil, err
+			}
+			wOff := 76
+			if len(b) > 0 && b[0] == 1 {
+				wOff = 88
+			}
+			if len(b) >= wOff+8 {
+				meta.Width = int(binary.BigEndian.Uint32(b[wOff:]) >> 16)
+				meta.Height = int(binary.BigEndian.Uint32(b[wOff+4:]) >> 16)
+			}
+		}
+
+		stbl, err := childBoxes(r, trak, "mdia", "minf", "stbl")
+		if err != nil {
+			return nil, err
+		}
+		if stsd, ok := findBox(stbl, "stsd"); ok {
+			b, err := readBox(r, stsd, 16)
+			if err == nil && len(b) >= 16 {
+				fourcc := string(b[12:16])
+				meta.Codec = fourcc
+				if name, ok := mp4Codecs[fourcc]; ok {
+					meta.Codec = name
+				}
+			}
+		}
+		break
+	}
+
+	meta.Poster = mp4Cover(r, boxes)
+
+	return meta, nil
+}
+
+// mp4Cover returns the iTunes-style cover art in moov/udta/meta/ilst/covr.
+func mp4Cover(r io.ReaderAt, moov []mp4Box) []byte {
+	udta, ok := findBox(moov, "udta")
+	if !ok {
+		return nil
+	}
+
+	children, err := mp4Boxes(r, udta.start, udta.end)
+	if err != nil {
+		return nil
+	}
+
+	m, ok := findBox(children, "meta")
+	if !ok {
+		return nil
+	}
+
+	// In MP4 "meta" is a full box with version and flags before its
+	// children; QuickTime leaves them out.
+	items, err := mp4Boxes(r, m.start+4, m.end)
+	if _, ok := findBox(items, "ilst"); err != nil || !ok {
+		items, _ = mp4Boxes(r, m.start, m.end)
+	}
+
+	ilst, ok := findBox(items, "ilst")
+	if !ok {
+		return nil
+	}
+
+	covr, err := childBoxes(r, ilst, "covr")
+	if err != nil {
+		return nil
+	}
+
+	// The data box starts with a type indicator and a locale.
+	d, ok := findBox(covr, "data")
+	if !ok || d.end-d.start <= 8 || d.end-d.start-8 > maxPosterBytes {
+		return nil
+	}
+
+	data, err := readBox(r, mp4Box{start: d.start + 8, end: d.end}, maxPosterBytes)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// Matroska / WebM (EBML)
+
+const (
+	ebmlHeader      = 0x1A45DFA3
+	ebmlDocType     = 0x4282
+	mkvSegment      = 0x18538067
+	mkvInfo         = 0x1549A966
+	mkvTimecode     = 0x2AD7B1
+	mkvDuration     = 0x4489
+	mkvTracks       = 0x1654AE6B
+	mkvTrackEntry   = 0xAE
+	mkvTrackType    = 0x83
+	mkvCodecID      = 0x86
+	mkvVideo        = 0xE0
+	mkvPixelWidth   = 0xB0
+	mkvPixelHeight  = 0xBA
+	mkvAttachments  = 0x1941A469
+	mkvAttachedFile = 0x61A7
+	mkvFileMimeType = 0x4660
+	mkvFileData     = 0x465C
+	mkvCluster      = 0x1F43B675
+)
+
+type ebmlElement struct {
+	id    uint32
+	start int64 // payload start
+	end   int64
+}
+
+// readVint reads an EBML variable-length integer at off. For IDs the
+// length marker is kept, for sizes it is masked off.
+func readVint(r io.ReaderAt, off int64, keepMarker bool) (uint64, int, bool, error) {
+	var b [8]byte
+	if _, err := r.ReadAt(b[:1], off); err != nil {
+		return 0, 0, false, err
+	}
+
+	n := 1
+	for mask := byte(0x80); n <= 8 && b[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > 8 {
+		return 0, 0, false, errUnsupportedContainer
+	}
+
+	if n > 1 {
+		if _, err := r.ReadAt(b[1:n], off+1); err != nil {
+			return 0, 0, false, err
+		}
+	}
+
+	v := uint64(b[0])
+	if !keepMarker {
+		v &= uint64(0xFF >> n)
+	}
+	allOnes := v == uint64(0xFF>>n)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+		allOnes = allOnes && b[i] == 0xFF
+	}
+
+	return v, n, allOnes, nil
+}
+
+// ebmlChildren lists the elements between start and end. An element of
+// unknown size extends to end, so listing stops after it.
+func ebmlChildren(r io.ReaderAt, start, end int64) ([]ebmlElement, error) {
+	var elems []ebmlElement
+
+	for off := start; off < end; {
+		id, n, _, err := readVint(r, off, true)
+		if err != nil {
+			return nil, err
+		}
+
+		size, m, unknown, err := readVint(r, off+int64(n), false)
+		if err != nil {
+			return nil, err
+		}
+
+		payload := off + int64(n+m)
+		if payload > end {
+			// The header runs past the parent.
+			return nil, errUnsupportedContainer
+		}
+		elemEnd := payload + int64(size)
+		if unknown || elemEnd > end {
+			elemEnd = end
+		}
+
+		elems = append(elems, ebmlElement{id: uint32(id), start: payload, end: elemEnd})
+		if unknown || id == mkvCluster {
+			// Frame data follows; everything we want comes before it.
+			break
+		}
+		off = elemEnd
+	}
+
+	return elems, nil
+}
+
+func ebmlBytes(r io.ReaderAt, e ebmlElement, max int64) ([]byte, error) {
+	n := e.end - e.start
+	if n < 0 || n > max {
+		return nil, errUnsupportedContainer
+	}
+
+	b := make([]byte, n)
+	_, err := r.ReadAt(b, e.start)
+	return b, err
+}
+
+func ebmlUint(r io.ReaderAt, e ebmlElement) uint64 {
+	b, err := ebmlBytes(r, e, 8)
+	if err != nil {
+		return 0
+	}
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v
+}
+
+func ebmlFloat(r io.ReaderAt, e ebmlElement) float64 {
+	b, err := ebmlBytes(r, e, 8)
+	if err != nil {
+		return 0
+	}
+
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+func probeWebM(r io.ReaderAt, size int64) (*videoMeta, error) {
+	top, err := ebmlChildren(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(top) < 2 || top[0].id != ebmlHeader {
+		return nil, errUnsupportedContainer
+	}
+
+	header, err := ebmlChildren(r, top[0].start, top[0].end)
+	if err != nil {
+		return nil, err
+	}
+
+	docType := ""
+	for _, e := range header {
+		if e.id == ebmlDocType {
+			b, _ := ebmlBytes(r, e, 32)
+			docType = string(b)
+		}
+	}
+	if docType != "webm" && docType != "matroska" {
+		return nil, errUnsupportedContainer
+	}
+
+	var segment *ebmlElement
+	for i := range top {
+		if top[i].id == mkvSegment {
+			segment = &top[i]
+		}
+	}
+	if segment == nil {
+		return nil, errUnsupportedContainer
+	}
+
+	children, err := ebmlChildren(r, segment.start, segment.end)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &videoMeta{}
+	timecodeScale := uint64(1000000)
+	var duration float64
+
+	for _, c := range children {
+		switch c.id {
+		case mkvInfo:
+			info, err := ebmlChildren(r, c.start, c.end)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range info {
+				switch e.id {
+				case mkvTimecode:
+					timecodeScale = ebmlUint(r, e)
+				case mkvDuration:
+					duration = ebmlFloat(r, e)
+				}
+			}
+		case mkvTracks:
+			tracks, err := ebmlChildren(r, c.start, c.end)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range tracks {
+				if t.id == mkvTrackEntry && meta.Codec == "" {
+					webmTrack(r, t, meta)
+				}
+			}
+		case mkvAttachments:
+			files, err := ebmlChildren(r, c.start, c.end)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				if f.id == mkvAttachedFile && meta.Poster == nil {
+					meta.Poster = webmCover(r, f)
+				}
+			}
+		}
+	}
+
+	meta.Duration = duration * float64(timecodeScale) / 1e9
+
+	return meta, nil
+}
+
+func webmTrack(r io.ReaderAt, track ebmlElement, meta *videoMeta) {
+	fields, err := ebmlChildren(r, track.start, track.end)
+	if err != nil {
+		return
+	}
+
+	var video bool
+	var codec string
+	var width, height int
+
+	for _, f := range fields {
+		switch f.id {
+		case mkvTrackType:
+			video = ebmlUint(r, f) == 1
+		case mkvCodecID:
+			b, _ := ebmlBytes(r, f, 64)
+			codec = string(b)
+		case mkvVideo:
+			v, _ := ebmlChildren(r, f.start, f.end)
+			for _, e := range v {
+				switch e.id {
+				case mkvPixelWidth:
+					width = int(ebmlUint(r, e))
+				case mkvPixelHeight:
+					height = int(ebmlUint(r, e))
+				}
+			}
+		}
+	}
+
+	if !video {
+		return
+	}
+
+	switch codec {
+	case "V_VP8":
+		meta.Codec = "vp8"
+	case "V_VP9":
+		meta.Codec = "vp9"
+	case "V_AV1":
+		meta.Codec = "av1"
+	default:
+		meta.Codec = codec
+	}
+	meta.Width, meta.Height = width, height
+}
+
+func webmCover(r io.ReaderAt, file ebmlElement) []byte {
+	fields, err := ebmlChildren(r, file.start, file.end)
+	if err != nil {
+		return nil
+	}
+
+	var mime string
+	var data []byte
+	for _, f := range fields {
+		switch f.id {
+		case mkvFileMimeType:
+			b, _ := ebmlBytes(r, f, 64)
+			mime = string(b)
+		case mkvFileData:
+			data, _ = ebmlBytes(r, f, maxPosterBytes)
+		}
+	}
+
+	if mime != "image/jpeg" && mime != "image/png" {
+		return nil
+	}
+
+	return data
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func buildBox(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+func mp4Fixture() []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 2500)
+
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 640<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 360<<16)
+
+	hdlr := append(make([]byte, 8), "vide"...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+
+	stsd := binary.BigEndian.AppendUint32(make([]byte, 4), 1)
+	stsd = append(stsd, buildBox("avc1", make([]byte, 8))...)
+
+	return append(buildBox("ftyp", []byte("isom"), make([]byte, 4)),
+		buildBox("moov",
+			buildBox("mvhd", mvhd),
+			buildBox("trak",
+				buildBox("tkhd", tkhd),
+				buildBox("mdia",
+					buildBox("hdlr", hdlr),
+					buildBox("minf", buildBox("stbl", buildBox("stsd", stsd)))),
+			),
+		)...)
+}
+
+func ebml(id uint32, payload ...[]byte) []byte {
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> shift); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+
+	body := bytes.Join(payload, nil)
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(body)))
+	size[0] = 0x01
+	return append(append(b, size...), body...)
+}
+
+func ebmlFloat64(f float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(f))
+}
+
+func webmFixture() []byte {
+	return append(ebml(ebmlHeader, ebml(ebmlDocType, []byte("webm"))),
+		ebml(mkvSegment,
+			ebml(mkvInfo,
+				ebml(mkvTimecode, []byte{0x0F, 0x42, 0x40}),
+				ebml(mkvDuration, ebmlFloat64(2500)),
+			),
+			ebml(mkvTracks,
+				ebml(mkvTrackEntry,
+					ebml(mkvTrackType, []byte{1}),
+					ebml(mkvCodecID, []byte("V_VP9")),
+					ebml(mkvVideo,
+						ebml(mkvPixelWidth, []byte{0x02, 0x80}),
+						ebml(mkvPixelHeight, []byte{0x01, 0x68}),
+					),
+				),
+			),
+		)...)
+}
+
+func TestProbeVideo(t *testing.T) {
+	tests := []struct {
+		name  string
+		mime  string
+		data  []byte
+		codec string
+	}{
+		{"mp4", "video/mp4", mp4Fixture(), "h264"},
+		{"webm", "video/webm", webmFixture(), "vp9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := probeVideo(bytes.NewReader(tt.data), int64(len(tt.data)), tt.mime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Width != 640 || meta.Height != 360 || meta.Codec != tt.codec || meta.Duration != 2.5 {
+				t.Errorf("got %+v", meta)
+			}
+		})
+	}
+}
+
+func TestProbeVideoMalformed(t *testing.T) {
+	mp4 := mp4Fixture()
+	webm := webmFixture()
+
+	hugeBox := append([]byte{0, 0, 0, 1}, "ftyp"...)
+	hugeBox = binary.BigEndian.AppendUint64(hugeBox, math.MaxInt64)
+
+	tests := []struct {
+		name string
+		mime string
+		data []byte
+	}{
+		{"empty mp4", "video/mp4", nil},
+		{"truncated mp4", "video/mp4", mp4[:len(mp4)-10]},
+		{"mp4 box larger than file", "video/mp4", append(buildBox("ftyp"), 0xFF, 0xFF, 0xFF, 0xFF, 'm', 'o', 'o', 'v')},
+		{"mp4 box smaller than its header", "video/mp4", append([]byte{0, 0, 0, 4}, "ftyp"...)},
+		{"mp4 64-bit size overflowing", "video/mp4", hugeBox},
+		{"mp4 without moov", "video/mp4", buildBox("ftyp", []byte("isom"))},
+		{"empty webm", "video/webm", nil},
+		{"truncated webm", "video/webm", webm[:len(webm)-10]},
+		// A child header running past its parent.
+		{"webm header past parent", "video/webm", []byte{0x1A, 0x45, 0xDF, 0xA3, 0x81, 0x42, 0x82, 0x81, 'x', 0x18, 0x53, 0x80, 0x67, 0x80}},
+		{"webm without segment", "video/webm", ebml(ebmlHeader, ebml(ebmlDocType, []byte("webm")))},
+		{"webm invalid vint", "video/webm", []byte{0x00, 0x00, 0x00, 0x00}},
+		{"mp4 as webm", "video/webm", mp4},
+		{"webm as mp4", "video/mp4", webm},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := probeVideo(bytes.NewReader(tt.data), int64(len(tt.data)), tt.mime)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func FuzzProbeMP4(f *testing.F) {
+	f.Add(mp4Fixture())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		probeMP4(bytes.NewReader(data), int64(len(data)))
+	})
+}
+
+func FuzzProbeWebM(f *testing.F) {
+	f.Add(webmFixture())
+	f.Add([]byte{0x1A, 0x45, 0xDF, 0xA3, 0x81, 0x42, 0x82, 0x81, 'x', 0x18, 0x53, 0x80, 0x67, 0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		probeWebM(bytes.NewReader(data), int64(len(data)))
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diamcircle/go/amount"
+	"github.com/diamcircle/go/clients/auroraclient"
+	"github.com/diamcircle/go/keypair"
+	"github.com/diamcircle/go/protocols/aurora/base"
+	"github.com/diamcircle/go/protocols/aurora/operations"
+)
+
+const (
+	// pendingTimeout is how long a pending tip without ValidUntil may go
+	// unseen on chain before the reconciler gives up on it.
+	pendingTimeout = 10 * time.Minute
+
+	// ledgerCloseMargin allows for the ledger closing and being ingested
+	// after a transaction's upper time bound.
+	ledgerCloseMargin = time.Minute
+)
+
+// watchedAccounts returns the reward account plus any tip accounts listed
+// in TIP_ACCOUNTS (comma separated).
+func (app *Config) watchedAccounts() []string {
+	var accounts []string
+
+	if kp, err := keypair.ParseFull(app.RewardSeed); err == nil {
+		accounts = append(accounts, kp.Address())
+	}
+
+	for _, a := range strings.Split(envOr("TIP_ACCOUNTS", ""), ",") {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			accounts = append(accounts, a)
+		}
+	}
+
+	return accounts
+}
+
+// watchPayments streams payments for every watched account and reconciles
+// pending ledger records until ctx is cancelled.
+func (app *Config) watchPayments(ctx context.Context) {
+	for _, account := range app.watchedAccounts() {
+		go app.streamAccount(ctx, account)
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			app.reconcilePending()
+		}
+	}
+}
+
+func (app *Config) streamAccount(ctx context.Context, account string) {
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		ledgerMutex.Lock()
+		ledger, err := readLedger()
+		ledgerMutex.Unlock()
+		if err != nil {
+			log.Println("watcher: reading ledger:", err)
+		}
+
+		cursor := ledger.Cursors[account]
+		if cursor == "" {
+			cursor = "now"
+		}
+
+		request := auroraclient.OperationRequest{
+			ForAccount:    account,
+			Cursor:        cursor,
+			IncludeFailed: true,
+			Join:          "transactions",
+		}
+
+		err = app.Aurora.StreamPayments(ctx, request, func(op operations.Operation) {
+			app.handleOperation(account, op)
+			backoff = time.Second
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("watcher: stream for %s stopped: %v, retrying in %s", account, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (app *Config) handleOperation(account string, op operations.Operation) {
+	var memo string
+
+	switch p := op.(type) {
+	case operations.Payment:
+		if p.Transaction != nil {
+			memo = p.Transaction.Memo
+		}
+		matchPayment(p.GetTransactionHash(), memo, p.To, p.Amount, operationAssetName(p.Asset), p.TransactionSuccessful)
+	case operations.CreateAccount:
+		if p.Transaction != nil {
+			memo = p.Transaction.Memo
+		}
+		matchPayment(p.GetTransactionHash(), memo, p.Account, p.StartingBalance, "native", p.TransactionSuccessful)
+	}
+
+	err := updateLedger(func(l *PaymentLedger) error {
+		l.Cursors[account] = op.PagingToken()
+		return nil
+	})
+	if err != nil {
+		log.Println("watcher: saving cursor:", err)
+	}
+}
+
+func operationAssetName(a base.Asset) string {
+	if a.Type == "native" {
+		return "native"
+	}
+
+	return a.Code + ":" + a.Issuer
+}
+
+// matchPayment finds the pending record for a streamed payment, by
+// transaction hash first and by memo, recipient and amount otherwise, and
+// marks it confirmed or failed. A record given up on as failed is still
+// confirmed if its transaction turns up.
+func matchPayment(txHash, memo, to, amt, asset string, successful bool) {
+	status := paymentConfirmed
+	reason := ""
+	if !successful {
+		status = paymentFailed
+		reason = "transaction failed on chain"
+	}
+
+	err := updateLedger(func(l *PaymentLedger) error {
+		for i := range l.Records {
+			rec := &l.Records[i]
+			late := successful && rec.Status == paymentFailed && rec.TxHash == txHash
+			if rec.Status != paymentPending && !late {
+				continue
+			}
+
+			byHash := rec.TxHash == txHash
+			byMemo := memo != "" && rec.Memo == memo && rec.To == to && rec.Asset == asset && sameAmount(rec.Amount, amt)
+			if !byHash && !byMemo {
+				continue
+			}
+
+			rec.TxHash = txHash
+			rec.Status = status
+			rec.Error = reason
+			rec.UpdatedAt = time.Now()
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("watcher: updating ledger:", err)
+	}
+}
+
+func sameAmount(a, b string) bool {
+	x, err := amount.ParseInt64(a)
+	if err != nil {
+		return false
+	}
+
+	y, err := amount.ParseInt64(b)
+	if err != nil {
+		return false
+	}
+
+	return x == y
+}
+
+// reconcilePending looks up pending records that the stream has not matched,
+// which covers payments to accounts we do not watch, and expires the ones
+// that never made it on chain.
+func (app *Config) reconcilePending() {
+	ledgerMutex.Lock()
+	ledger, err := readLedger()
+	ledgerMutex.Unlock()
+	if err != nil {
+		log.Println("watcher: reading ledger:", err)
+		return
+	}
+
+	for _, rec := range ledger.Records {
+		if rec.Status != paymentPending {
+			continue
+		}
+
+		tx, err := app.Aurora.TransactionDetail(rec.TxHash)
+		switch {
+		case err == nil && tx.Successful:
+			err = setPaymentStatus(rec.TxHash, paymentConfirmed, "")
+		case err == nil:
+			err = setPaymentStatus(rec.TxHash, paymentFailed, "transaction failed on chain")
+		case auroraclient.IsNotFoundError(err) && rec.expired(time.Now()):
+			err = setPaymentStatus(rec.TxHash, paymentFailed, "transaction not found on chain")
+		case auroraclient.IsNotFoundError(err):
+			err = nil
+		}
+		if err != nil {
+			log.Println("watcher: reconciling", rec.TxHash, err)
+		}
+	}
+}
+
+func (app *Config) getPostEarnings(w http.ResponseWriter, r *http.Request) {
+	type earningsP struct {
+		Id string `json:"id"`
+	}
+	var payload earningsP
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var v ValidationError
+	v.required("id", payload.Id)
+	if err := v.err(); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	totals, err := postEarnings(payload.Id)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{
+		Message: "confirmed on-chain earnings",
+		Data: map[string]interface{}{
+			"id":     payload.Id,
+			"totals": totals,
+		},
+	})
+}